@@ -124,13 +124,13 @@ func (c *Client) rawReq(method, path string, contentType string, in, out interfa
 		res.Body.Close()
 		return res, ErrNotFound
 	}
-	if res.StatusCode == 400 {
-		var body ct.ValidationError
+	if res.StatusCode == 400 || res.StatusCode == 422 {
 		defer res.Body.Close()
-		if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
-			return res, err
-		}
-		return res, body
+		return res, decodeValidationError(res)
+	}
+	if res.StatusCode == 204 {
+		res.Body.Close()
+		return res, nil
 	}
 	if res.StatusCode != 200 {
 		res.Body.Close()
@@ -147,6 +147,42 @@ func (c *Client) rawReq(method, path string, contentType string, in, out interfa
 	return res, nil
 }
 
+// decodeValidationError turns the body of a 400 or 422 response back into
+// the ct.ValidationError or ct.ValidationErrors the controller returned. The
+// job routes wrap them in a ct.Error, the other routes send them as they are.
+func decodeValidationError(res *http.Response) error {
+	var raw json.RawMessage
+	if err := json.NewDecoder(res.Body).Decode(&raw); err != nil {
+		return err
+	}
+	if res.StatusCode == 422 && len(raw) > 0 && raw[0] == '[' {
+		var errs ct.ValidationErrors
+		if err := json.Unmarshal(raw, &errs); err != nil {
+			return err
+		}
+		return errs
+	}
+	var body struct {
+		Code    string `json:"code"`
+		Field   string `json:"field"`
+		Message string `json:"message"`
+		Detail  struct {
+			Field  string              `json:"field"`
+			Errors ct.ValidationErrors `json:"errors"`
+		} `json:"detail"`
+	}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return err
+	}
+	switch body.Code {
+	case "":
+		return ct.ValidationError{Field: body.Field, Message: body.Message}
+	case ct.ErrorCodeValidations:
+		return body.Detail.Errors
+	}
+	return ct.ValidationError{Field: body.Detail.Field, Message: body.Message}
+}
+
 func (c *Client) send(method, path string, in, out interface{}) error {
 	_, err := c.rawReq(method, path, "", in, out)
 	return err
@@ -279,6 +315,11 @@ func (c *Client) GetApp(appID string) (*ct.App, error) {
 	return app, c.get(fmt.Sprintf("/apps/%s", appID), app)
 }
 
+func (c *Client) GetJobRelease(appID, jobID string) (*ct.JobRelease, error) {
+	res := &ct.JobRelease{}
+	return res, c.get(fmt.Sprintf("/apps/%s/jobs/%s/release", appID, jobID), res)
+}
+
 func (c *Client) GetJobLog(appID, jobID string) (io.ReadCloser, error) {
 	res, err := c.rawReq("GET", fmt.Sprintf("/apps/%s/jobs/%s/log", appID, jobID), "", nil, nil)
 	if err != nil {
@@ -287,6 +328,16 @@ func (c *Client) GetJobLog(appID, jobID string) (io.ReadCloser, error) {
 	return res.Body, nil
 }
 
+// StreamTypeLog returns an event stream of the logs of the app's jobs of the
+// given process type, including jobs that start later.
+func (c *Client) StreamTypeLog(appID, typ string) (io.ReadCloser, error) {
+	res, err := c.rawReq("GET", fmt.Sprintf("/apps/%s/types/%s/log?stream=true", appID, typ), "", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
 func (c *Client) RunJobAttached(appID string, job *ct.NewJob) (utils.ReadWriteCloser, error) {
 	data, err := toJSON(job)
 	if err != nil {
@@ -313,11 +364,57 @@ func (c *Client) RunJobDetached(appID string, req *ct.NewJob) (*ct.Job, error) {
 	return job, c.post(fmt.Sprintf("/apps/%s/jobs", appID), req, job)
 }
 
+// RunJobsDetached starts req.Count replicas of a one-off job, or one if
+// it is unset.
+func (c *Client) RunJobsDetached(appID string, req *ct.NewJob) ([]*ct.Job, error) {
+	if req.Count <= 1 {
+		job, err := c.RunJobDetached(appID, req)
+		if err != nil {
+			return nil, err
+		}
+		return []*ct.Job{job}, nil
+	}
+	var jobs []*ct.Job
+	return jobs, c.post(fmt.Sprintf("/apps/%s/jobs", appID), req, &jobs)
+}
+
+func (c *Client) RunImageJob(appID string, req *ct.NewImageJob) (*ct.Job, error) {
+	job := &ct.Job{}
+	return job, c.post(fmt.Sprintf("/apps/%s/runimage", appID), req, job)
+}
+
 func (c *Client) JobList(appID string) ([]*ct.Job, error) {
 	var jobs []*ct.Job
 	return jobs, c.get(fmt.Sprintf("/apps/%s/jobs", appID), &jobs)
 }
 
+func (c *Client) JobCount(appID string) (map[string]int, error) {
+	var counts map[string]int
+	return counts, c.get(fmt.Sprintf("/apps/%s/jobs/count", appID), &counts)
+}
+
+func (c *Client) HostJobs(hostID string) ([]*ct.Job, error) {
+	var jobs []*ct.Job
+	return jobs, c.get(fmt.Sprintf("/hosts/%s/jobs", hostID), &jobs)
+}
+
+// DrainHost cordons a host and moves its jobs to other hosts.
+func (c *Client) DrainHost(hostID string) (*ct.DrainHostResult, error) {
+	res := &ct.DrainHostResult{}
+	return res, c.post(fmt.Sprintf("/hosts/%s/drain", hostID), nil, res)
+}
+
+// SearchJobs returns the jobs of every app that have all of the given
+// attributes.
+func (c *Client) SearchJobs(attrs map[string]string) ([]*ct.Job, error) {
+	query := url.Values{}
+	for k, v := range attrs {
+		query.Set("attr."+k, v)
+	}
+	var jobs []*ct.Job
+	return jobs, c.get("/jobs?"+query.Encode(), &jobs)
+}
+
 func (c *Client) KeyList() ([]*ct.Key, error) {
 	var keys []*ct.Key
 	return keys, c.get("/keys", &keys)
@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ct "github.com/flynn/flynn-controller/types"
+	. "github.com/titanous/gocheck"
+)
+
+// Hook gocheck up to the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+func (S) TestRunJobsDetached(c *C) {
+	var reqs []*ct.NewJob
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, Equals, "POST")
+		c.Assert(r.URL.Path, Equals, "/apps/app0/jobs")
+		req := &ct.NewJob{}
+		c.Assert(json.NewDecoder(r.Body).Decode(req), IsNil)
+		reqs = append(reqs, req)
+		// a single job is returned as an object, several as an array
+		if req.Count <= 1 {
+			json.NewEncoder(w).Encode(&ct.Job{ID: "host0-job0"})
+			return
+		}
+		jobs := make([]*ct.Job, req.Count)
+		for i := range jobs {
+			jobs[i] = &ct.Job{ID: fmt.Sprintf("host%d-job%d", i, i)}
+		}
+		json.NewEncoder(w).Encode(jobs)
+	}))
+	defer srv.Close()
+	client, err := NewClient(srv.URL, "")
+	c.Assert(err, IsNil)
+
+	jobs, err := client.RunJobsDetached("app0", &ct.NewJob{ReleaseID: "release0", Count: 3})
+	c.Assert(err, IsNil)
+	c.Assert(jobs, HasLen, 3)
+	for i, j := range jobs {
+		c.Assert(j.ID, Equals, fmt.Sprintf("host%d-job%d", i, i))
+	}
+	c.Assert(reqs[0].Count, Equals, 3)
+	c.Assert(reqs[0].ReleaseID, Equals, "release0")
+
+	jobs, err = client.RunJobsDetached("app0", &ct.NewJob{ReleaseID: "release0"})
+	c.Assert(err, IsNil)
+	c.Assert(jobs, HasLen, 1)
+	c.Assert(jobs[0].ID, Equals, "host0-job0")
+}
@@ -0,0 +1,31 @@
+package main
+
+import "time"
+
+// clock tells the time for job timeouts, timestamps and cache expiry, so
+// that tests can move time on instead of sleeping.
+type clock interface {
+	Now() time.Time
+	// After is like time.After.
+	After(d time.Duration) <-chan time.Time
+	// NewTicker is like time.NewTicker.
+	NewTicker(d time.Duration) ticker
+}
+
+// ticker is the part of a time.Ticker that clocks provide.
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the system clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTicker(d time.Duration) ticker       { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct{ t *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
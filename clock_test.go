@@ -0,0 +1,168 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/titanous/gocheck"
+)
+
+// fakeClock only moves when it is advanced.
+type fakeClock struct {
+	mtx    sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+	// every is how often a ticker fires, it is zero for timers
+	every time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	t := &fakeTicker{c: c, ch: make(chan time.Time, 1)}
+	c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), ch: t.ch, every: d})
+	return t
+}
+
+type fakeTicker struct {
+	c  *fakeClock
+	ch chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.ch }
+
+func (t *fakeTicker) Stop() {
+	t.c.mtx.Lock()
+	defer t.c.mtx.Unlock()
+	pending := t.c.timers[:0]
+	for _, timer := range t.c.timers {
+		if timer.ch != t.ch {
+			pending = append(pending, timer)
+		}
+	}
+	t.c.timers = pending
+}
+
+// Waiting returns the number of timers and tickers that haven't fired or
+// been stopped.
+func (c *fakeClock) Waiting() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.timers)
+}
+
+// Unread returns the number of ticks that have been sent but not received.
+func (c *fakeClock) Unread() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	n := 0
+	for _, t := range c.timers {
+		if t.every != 0 {
+			n += len(t.ch)
+		}
+	}
+	return n
+}
+
+// Advance moves the clock on by d and fires the timers that are due. Like a
+// time.Ticker, a ticker that hasn't been read from drops the tick.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		if t.every == 0 {
+			t.ch <- c.now
+			continue
+		}
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+		for !t.at.After(c.now) {
+			t.at = t.at.Add(t.every)
+		}
+		pending = append(pending, t)
+	}
+	c.timers = pending
+}
+
+func (S) TestFakeClock(c *C) {
+	clk := newFakeClock()
+	start := clk.Now()
+	soon, later := clk.After(time.Second), clk.After(time.Minute)
+	c.Assert(clk.Waiting(), Equals, 2)
+
+	clk.Advance(time.Second)
+	c.Assert(clk.Now(), Equals, start.Add(time.Second))
+	select {
+	case t := <-soon:
+		c.Assert(t, Equals, clk.Now())
+	default:
+		c.Fatal("the timer did not fire")
+	}
+	select {
+	case <-later:
+		c.Fatal("the timer fired early")
+	default:
+	}
+	clk.Advance(time.Minute)
+	<-later
+	c.Assert(clk.Waiting(), Equals, 0)
+}
+
+func (S) TestFakeTicker(c *C) {
+	clk := newFakeClock()
+	t := clk.NewTicker(time.Second)
+	clk.Advance(500 * time.Millisecond)
+	select {
+	case <-t.C():
+		c.Fatal("the ticker fired early")
+	default:
+	}
+	clk.Advance(time.Second)
+	c.Assert(<-t.C(), Equals, clk.Now())
+	clk.Advance(time.Second)
+	clk.Advance(time.Second)
+	// the second tick is dropped as the first wasn't read
+	<-t.C()
+	select {
+	case <-t.C():
+		c.Fatal("the ticker fired twice")
+	default:
+	}
+	t.Stop()
+	c.Assert(clk.Waiting(), Equals, 0)
+}
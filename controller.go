@@ -7,11 +7,18 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-controller/utils"
 	"github.com/flynn/go-discoverd"
 	"github.com/flynn/go-flynn/cluster"
 	"github.com/flynn/go-flynn/postgres"
@@ -23,11 +30,18 @@ import (
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/binding"
 	"github.com/martini-contrib/render"
+	"github.com/technoweenie/grohl"
 )
 
 var ErrNotFound = errors.New("controller: resource not found")
 
 func main() {
+	logger, err := newLogger(os.Getenv("LOG_FORMAT"), os.Stderr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	grohl.SetLogger(logger)
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "3000"
@@ -57,8 +71,97 @@ func main() {
 		log.Fatal(err)
 	}
 
-	handler, _ := appHandler(handlerConfig{db: db, cc: cc, sc: sc, dc: discoverd.DefaultClient, key: os.Getenv("AUTH_KEY")})
-	log.Fatal(http.ListenAndServe(addr, handler))
+	logKeepAlive, err := parseDurationEnv("LOG_KEEPALIVE", defaultLogKeepAlive)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logBufferSize, err := parseIntEnv("LOG_BUFFER_SIZE", defaultLogBufferSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jobEnv := parseJobEnv(os.Environ())
+	maxAppJobs, err := parseIntEnv("MAX_APP_JOBS", 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	maxStreams, err := parseIntEnv("MAX_STREAMS", 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hostDial, err := parseDurationEnv("HOST_DIAL_TIMEOUT", defaultHostDialTimeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hostAttach, err := parseDurationEnv("HOST_ATTACH_TIMEOUT", defaultHostAttachTimeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	shutdownGrace, err := parseDurationEnv("SHUTDOWN_GRACE", defaultShutdownGrace)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jobHistorySize, err := parseIntEnv("JOB_HISTORY_SIZE", defaultJobHistorySize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jobHistoryTTL, err := parseDurationEnv("JOB_HISTORY_TTL", defaultJobHistoryTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hostPoolIdle, err := parseDurationEnv("HOST_POOL_IDLE_TIMEOUT", defaultHostPoolIdleTimeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sched, err := parseScheduler(os.Getenv("SCHEDULER"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	hosts := newHostPool(cc, hostPoolIdle, realClock{})
+	defer hosts.Close()
+
+	sessions := newSessionRegistry(realClock{})
+	handler, _ := appHandler(handlerConfig{
+		db:            db,
+		cc:            hosts,
+		sc:            sc,
+		dc:            discoverd.DefaultClient,
+		key:           os.Getenv("AUTH_KEY"),
+		log:           grohl.NewContext(grohl.Data{"app": "controller"}),
+		logKeepAlive:  logKeepAlive,
+		logBufferSize: logBufferSize,
+		jobEnv:        jobEnv,
+		maxAppJobs:    maxAppJobs,
+		maxStreams:    maxStreams,
+		historySize:   jobHistorySize,
+		historyTTL:    jobHistoryTTL,
+		hostDial:      hostDial,
+		hostAttach:    hostAttach,
+		sessions:      sessions,
+		scheduler:     sched,
+	})
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stopping := make(chan struct{})
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+		<-ch
+		// stop accepting connections, open sessions are ended below
+		close(stopping)
+		ln.Close()
+	}()
+	err = http.Serve(ln, handler)
+	select {
+	case <-stopping:
+	default:
+		log.Fatal(err)
+	}
+	if !sessions.shutdown(shutdownGrace) {
+		grohl.Log(grohl.Data{"at": "shutdown", "status": "grace_expired", "grace": shutdownGrace.String()})
+	}
 }
 
 type dbWrapper interface {
@@ -73,37 +176,319 @@ type handlerConfig struct {
 	sc  strowgerc.Client
 	dc  *discoverd.Client
 	key string
+	log *grohl.Context
+
+	logKeepAlive  time.Duration
+	logBufferSize int
+	jobEnv        map[string]string
+	maxAppJobs    int
+	maxStreams    int
+	historySize   int
+	historyTTL    time.Duration
+	hostDial      time.Duration
+	hostAttach    time.Duration
+	sessions      *sessionRegistry
+	clock         clock
+	scheduler     scheduler
+}
+
+// jobEnvPrefix marks controller environment variables that are set in every
+// one-off job, DEFAULT_JOB_ENV_FOO=bar sets FOO=bar.
+const jobEnvPrefix = "DEFAULT_JOB_ENV_"
+
+func parseJobEnv(environ []string) map[string]string {
+	env := make(map[string]string)
+	for _, e := range environ {
+		if !strings.HasPrefix(e, jobEnvPrefix) {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(e, jobEnvPrefix), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		env[kv[0]] = kv[1]
+	}
+	return env
+}
+
+// jobLimitRetryAfter is how many seconds clients are told to wait after
+// hitting an app's cap on one-off jobs.
+const jobLimitRetryAfter = "10"
+
+func parseIntEnv(name string, def int) (int, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %q", name, s)
+	}
+	return n, nil
+}
+
+func parseDurationEnv(name string, def time.Duration) (time.Duration, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", name, err)
+	}
+	return d, nil
 }
 
 type ResponseHelper interface {
 	Error(error)
 	JSON(int, interface{})
 	WriteHeader(int)
+	// NoContent responds with a 204 for handlers that succeed without
+	// anything to return.
+	NoContent()
 }
 
 type responseHelper struct {
 	http.ResponseWriter
 	render.Render
+	// envelope is set for the job routes, which send errors as a ct.Error,
+	// the other routes keep the bodies that they have always sent.
+	envelope bool
+	// log is the request's logger, internal errors are logged to it
+	log *grohl.Context
+}
+
+func (r *responseHelper) NoContent() {
+	r.WriteHeader(204)
 }
 
 func (r *responseHelper) Error(err error) {
 	switch err.(type) {
-	case ct.ValidationError:
-		r.JSON(400, err)
-	case *json.SyntaxError, *json.UnmarshalTypeError:
-		r.JSON(400, ct.ValidationError{Message: "The provided JSON input is invalid"})
+	case *JobLimitError:
+		r.ResponseWriter.Header().Set("Retry-After", jobLimitRetryAfter)
+	case *StreamLimitError:
+		r.ResponseWriter.Header().Set("Retry-After", streamLimitRetryAfter)
 	default:
-		if err == ErrNotFound {
-			r.WriteHeader(404)
-			return
+		if err == cluster.ErrWouldWait {
+			r.ResponseWriter.Header().Set("Retry-After", "1")
 		}
-		log.Println(err)
-		r.JSON(500, struct{}{})
+	}
+	status, body := errorResponse(err)
+	if status == 500 {
+		r.log.Log(grohl.Data{"at": "error", "error": err})
+	}
+	if r.envelope {
+		r.JSON(status, body)
+		return
+	}
+	if legacy := legacyErrorBody(err, body); legacy != nil {
+		r.JSON(status, legacy)
+	} else {
+		r.WriteHeader(status)
 	}
 }
 
-func responseHelperHandler(c martini.Context, w http.ResponseWriter, r render.Render) {
-	c.MapTo(&responseHelper{w, r}, (*ResponseHelper)(nil))
+// legacyErrorBody returns the body that the routes outside of the job API
+// send for err, or nil if the response has no body.
+func legacyErrorBody(err error, body *ct.Error) interface{} {
+	switch e := err.(type) {
+	case ct.ValidationError, ct.ValidationErrors:
+		return err
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return ct.ValidationError{Message: body.Message}
+	case *NotAcceptableError:
+		return struct {
+			Message   string   `json:"message"`
+			Supported []string `json:"supported"`
+		}{e.Error(), e.Supported}
+	}
+	switch body.Code {
+	case ct.ErrorCodeNotFound:
+		return nil
+	case ct.ErrorCodeWouldWait, ct.ErrorCodeInternal:
+		return struct{}{}
+	}
+	return struct {
+		Message string `json:"message"`
+	}{body.Message}
+}
+
+// errorResponse returns the status and body of the response for err.
+func errorResponse(err error) (int, *ct.Error) {
+	switch e := err.(type) {
+	case ct.ValidationError:
+		body := &ct.Error{Code: ct.ErrorCodeValidation, Message: e.Message}
+		if e.Field != "" {
+			body.Detail = map[string]interface{}{"field": e.Field}
+		}
+		return 400, body
+	case ct.ValidationErrors:
+		return 422, &ct.Error{
+			Code:    ct.ErrorCodeValidations,
+			Message: e.Error(),
+			Detail:  map[string]interface{}{"errors": e},
+		}
+	case *json.SyntaxError:
+		return 400, &ct.Error{
+			Code:    ct.ErrorCodeInvalidJSON,
+			Message: fmt.Sprintf("The provided JSON input is invalid at byte %d: %s", e.Offset, e),
+			Detail:  map[string]interface{}{"offset": e.Offset},
+		}
+	case *json.UnmarshalTypeError:
+		return 400, &ct.Error{Code: ct.ErrorCodeInvalidJSON, Message: "The provided JSON input is invalid: " + e.Error()}
+	case *RequestTooLargeError:
+		return 413, &ct.Error{
+			Code:    ct.ErrorCodeRequestTooLarge,
+			Message: e.Error(),
+			Detail:  map[string]interface{}{"limit": e.Limit},
+		}
+	case *ScheduleError:
+		return 503, &ct.Error{
+			Code:    ct.ErrorCodeScheduleFailed,
+			Message: e.Error(),
+			Detail:  map[string]interface{}{"host_id": e.HostID, "job_id": e.JobID},
+		}
+	case *HostDialError:
+		return 502, &ct.Error{
+			Code:    ct.ErrorCodeUnreachable,
+			Message: e.Error(),
+			Detail:  map[string]interface{}{"host_id": e.HostID},
+		}
+	case *UnreachableError:
+		body := &ct.Error{Code: ct.ErrorCodeUnreachable, Message: e.Error()}
+		if e.HostID != "" {
+			body.Detail = map[string]interface{}{"host_id": e.HostID}
+		}
+		return 502, body
+	case *HostTimeoutError:
+		return 504, &ct.Error{
+			Code:    ct.ErrorCodeHostTimeout,
+			Message: e.Error(),
+			Detail:  map[string]interface{}{"host_id": e.HostID},
+		}
+	case *NotAcceptableError:
+		return 406, &ct.Error{
+			Code:    ct.ErrorCodeNotAcceptable,
+			Message: e.Error(),
+			Detail:  map[string]interface{}{"supported": e.Supported},
+		}
+	case *JobLimitError:
+		return 429, &ct.Error{
+			Code:    ct.ErrorCodeJobLimit,
+			Message: e.Error(),
+			Detail:  map[string]interface{}{"limit": e.Limit},
+		}
+	case *StreamLimitError:
+		return 503, &ct.Error{
+			Code:    ct.ErrorCodeStreamLimit,
+			Message: e.Error(),
+			Detail:  map[string]interface{}{"limit": e.Limit},
+		}
+	}
+	switch err {
+	case ErrNotFound:
+		return 404, &ct.Error{Code: ct.ErrorCodeNotFound, Message: "not found"}
+	case ErrNoHosts:
+		return 503, &ct.Error{Code: ct.ErrorCodeNoHosts, Message: err.Error()}
+	case cluster.ErrWouldWait:
+		return 503, &ct.Error{Code: ct.ErrorCodeWouldWait, Message: "the job is not ready to be attached to, try again"}
+	}
+	// the message is not sent as it may leak internal details
+	return 500, &ct.Error{Code: ct.ErrorCodeInternal, Message: "internal error"}
+}
+
+// NotAcceptableError is returned when a request only accepts media types that
+// the endpoint can't respond with.
+type NotAcceptableError struct {
+	Supported []string
+}
+
+func (e *NotAcceptableError) Error() string {
+	return "none of the accepted media types are supported, use one of " + strings.Join(e.Supported, ", ")
+}
+
+// checkAccept returns a NotAcceptableError if the request has an Accept header
+// that matches none of the supported media types. Requests without one
+// accept anything.
+func checkAccept(req *http.Request, supported ...string) error {
+	accept := strings.Join(req.Header["Accept"], ",")
+	if strings.TrimSpace(accept) == "" {
+		return nil
+	}
+	for _, r := range strings.Split(accept, ",") {
+		params := strings.Split(r, ";")
+		typ := strings.ToLower(strings.TrimSpace(params[0]))
+		if acceptQuality(params[1:]) == 0 {
+			continue
+		}
+		if typ == "*/*" {
+			return nil
+		}
+		for _, s := range supported {
+			if typ == s || strings.HasSuffix(typ, "/*") && strings.HasPrefix(s, strings.TrimSuffix(typ, "*")) {
+				return nil
+			}
+		}
+	}
+	return &NotAcceptableError{Supported: supported}
+}
+
+// acceptsGzip reports whether the request accepts gzip encoded responses.
+func acceptsGzip(req *http.Request) bool {
+	for _, e := range strings.Split(strings.Join(req.Header["Accept-Encoding"], ","), ",") {
+		params := strings.Split(e, ";")
+		if enc := strings.ToLower(strings.TrimSpace(params[0])); (enc == "gzip" || enc == "*") && acceptQuality(params[1:]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func acceptQuality(params []string) float64 {
+	for _, p := range params {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+			if q, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err == nil {
+				return q
+			}
+		}
+	}
+	return 1
+}
+
+func responseHelperHandler(c martini.Context, w http.ResponseWriter, r render.Render, l *grohl.Context, req *http.Request) {
+	c.MapTo(&responseHelper{ResponseWriter: w, Render: r, envelope: isJobRoute(req.URL.Path), log: l}, (*ResponseHelper)(nil))
+}
+
+// isJobRoute reports whether path belongs to the job API, the routes that are
+// described by /openapi.json.
+func isJobRoute(path string) bool {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) == 1:
+		return parts[0] == "jobs"
+	case len(parts) >= 3 && (parts[0] == "apps" || parts[0] == "hosts"):
+		return parts[2] == "jobs" || parts[0] == "apps" && parts[2] == "runimage"
+	}
+	return false
+}
+
+// requestIDHeader carries the ID that is added to a request's log lines, so
+// that a client can find what the controller did for one of its requests.
+const requestIDHeader = "X-Request-ID"
+
+var requestIDPattern = regexp.MustCompile(`^[\w.:-]{1,128}$`)
+
+// requestIDHandler tags the request's logger with the ID sent by the client,
+// or a new one if it is missing or unsuitable for logs, and echoes the ID in
+// the response.
+func requestIDHandler(c martini.Context, l *grohl.Context, w http.ResponseWriter, req *http.Request) {
+	id := req.Header.Get(requestIDHeader)
+	if !requestIDPattern.MatchString(id) {
+		id = utils.UUID()
+	}
+	w.Header().Set(requestIDHeader, id)
+	c.Map(l.New(grohl.Data{"request_id": id}))
 }
 
 func appHandler(c handlerConfig) (http.Handler, *martini.Martini) {
@@ -112,6 +497,8 @@ func appHandler(c handlerConfig) (http.Handler, *martini.Martini) {
 	m.Use(martini.Logger())
 	m.Use(martini.Recovery())
 	m.Use(render.Renderer())
+	// the response helper logs with the request's ID
+	m.Use(requestIDHandler)
 	m.Use(responseHelperHandler)
 	m.Action(r.Handle)
 
@@ -128,9 +515,47 @@ func appHandler(c handlerConfig) (http.Handler, *martini.Martini) {
 	m.Map(appRepo)
 	m.Map(artifactRepo)
 	m.Map(releaseRepo)
+	m.MapTo(releaseJobSource{releaseRepo, artifactRepo}, (*jobSource)(nil))
 	m.Map(formationRepo)
 	m.Map(c.dc)
-	m.MapTo(c.cc, (*clusterClient)(nil))
+	cordons := newHostCordons(c.cc)
+	m.Map(cordons)
+	m.MapTo(cordons, (*clusterClient)(nil))
+	if c.scheduler == nil {
+		c.scheduler = leastLoadedScheduler{}
+	}
+	m.MapTo(c.scheduler, (*scheduler)(nil))
+	if c.log == nil {
+		c.log = grohl.NewContext(grohl.Data{"app": "controller"})
+	}
+	m.Map(c.log)
+	if c.clock == nil {
+		c.clock = realClock{}
+	}
+	m.MapTo(c.clock, (*clock)(nil))
+
+	logConf := &logConfig{keepAlive: c.logKeepAlive, bufferSize: c.logBufferSize}
+	if logConf.keepAlive <= 0 {
+		logConf.keepAlive = defaultLogKeepAlive
+	}
+	m.Map(logConf)
+	m.Map(&jobConfig{env: c.jobEnv, maxAppJobs: c.maxAppJobs})
+	hostConf := &hostConfig{dialTimeout: c.hostDial, attachTimeout: c.hostAttach, clock: c.clock}
+	if hostConf.dialTimeout <= 0 {
+		hostConf.dialTimeout = defaultHostDialTimeout
+	}
+	if hostConf.attachTimeout <= 0 {
+		hostConf.attachTimeout = defaultHostAttachTimeout
+	}
+	m.Map(hostConf)
+	m.Map(newIdempotencyCache(defaultIdempotencyTTL, c.clock))
+	m.Map(newStreamLimiter(c.maxStreams))
+	m.Map(newJobHistory(c.historySize, c.historyTTL, c.clock))
+	if c.sessions == nil {
+		c.sessions = newSessionRegistry(c.clock)
+	}
+	m.Map(c.sessions)
+	m.Map(newExitWatcher(c.cc, c.clock, c.sessions, c.log))
 	m.MapTo(c.sc, (*strowgerc.Client)(nil))
 	m.MapTo(c.dc, (*resource.DiscoverdClient)(nil))
 
@@ -140,15 +565,32 @@ func appHandler(c handlerConfig) (http.Handler, *martini.Martini) {
 	crud("artifacts", ct.Artifact{}, artifactRepo, r)
 	crud("keys", ct.Key{}, keyRepo, r)
 
+	r.Get("/healthz", healthCheck)
+	r.Get("/metrics", serveMetrics)
+	r.Get("/openapi.json", serveOpenAPI)
+
 	r.Put("/apps/:apps_id/formations/:releases_id", getAppMiddleware, getReleaseMiddleware, binding.Bind(ct.Formation{}), putFormation)
 	r.Get("/apps/:apps_id/formations/:releases_id", getAppMiddleware, getFormationMiddleware, getFormation)
 	r.Delete("/apps/:apps_id/formations/:releases_id", getAppMiddleware, getFormationMiddleware, deleteFormation)
 	r.Get("/apps/:apps_id/formations", getAppMiddleware, listFormations)
 
-	r.Post("/apps/:apps_id/jobs", getAppMiddleware, binding.Bind(ct.NewJob{}), runJob)
+	r.Post("/apps/:apps_id/jobs", getAppMiddleware, splitJobBody, binding.Bind(ct.NewJob{}), jobDepsMiddleware, runJob)
+	r.Post("/apps/:apps_id/runimage", getAppMiddleware, splitJobBody, binding.Bind(ct.NewImageJob{}), runImageMiddleware, jobDepsMiddleware, runJob)
 	r.Get("/apps/:apps_id/jobs", getAppMiddleware, jobList)
+	r.Delete("/apps/:apps_id/jobs", getAppMiddleware, killJobs)
+	r.Get("/apps/:apps_id/jobs/count", getAppMiddleware, jobCount)
+	r.Get("/apps/:apps_id/jobs/events", getAppMiddleware, jobEvents)
+	r.Get("/apps/:apps_id/jobs/:jobs_id", getAppMiddleware, connectHostMiddleware, getJob)
 	r.Delete("/apps/:apps_id/jobs/:jobs_id", getAppMiddleware, connectHostMiddleware, killJob)
-	r.Get("/apps/:apps_id/jobs/:jobs_id/log", getAppMiddleware, connectHostMiddleware, jobLog)
+	r.Get("/apps/:apps_id/jobs/:jobs_id/release", getAppMiddleware, connectHostMiddleware, getJobRelease)
+	r.Get("/apps/:apps_id/jobs/:jobs_id/log", getAppMiddleware, connectHostMiddleware, jobDepsMiddleware, jobLog)
+	r.Post("/apps/:apps_id/jobs/:jobs_id/attach", getAppMiddleware, connectHostMiddleware, binding.Bind(ct.JobAttach{}), attachJob)
+	r.Get("/apps/:apps_id/log", getAppMiddleware, appLog)
+	r.Get("/apps/:apps_id/types/:types_id/log", getAppMiddleware, appLog)
+
+	r.Get("/hosts/:hosts_id/jobs", hostJobs)
+	r.Post("/hosts/:hosts_id/drain", drainHost)
+	r.Get("/jobs", searchJobs)
 
 	r.Put("/apps/:apps_id/release", getAppMiddleware, binding.Bind(releaseID{}), setAppRelease)
 	r.Get("/apps/:apps_id/release", getAppMiddleware, getAppRelease)
@@ -173,6 +615,11 @@ func rpcMuxHandler(main http.Handler, rpch http.Handler, authKey string) http.Ha
 			w.WriteHeader(200)
 			return
 		}
+		if r.URL.Path == "/healthz" {
+			// health checks come from load balancers without credentials
+			main.ServeHTTP(w, r)
+			return
+		}
 		_, password, _ := parseBasicAuth(r.Header)
 		if len(password) != len(authKey) || subtle.ConstantTimeCompare([]byte(password), []byte(authKey)) != 1 {
 			w.WriteHeader(401)
@@ -186,6 +633,42 @@ func rpcMuxHandler(main http.Handler, rpch http.Handler, authKey string) http.Ha
 	})
 }
 
+// healthCheckTimeout is how long healthCheck waits for the cluster to list
+// its hosts.
+var healthCheckTimeout = 2 * time.Second
+
+type healthStatus struct {
+	Hosts int `json:"hosts"`
+}
+
+// healthCheck reports whether the controller can reach the cluster, it is
+// intended for load balancers and does not contact individual hosts. Failures
+// are only logged, the endpoint needs no credentials.
+func healthCheck(cc clusterClient, clk clock, l *grohl.Context, r ResponseHelper) {
+	type result struct {
+		hosts int
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		hosts, err := cc.ListHosts()
+		ch <- result{len(hosts), err}
+	}()
+
+	var res result
+	select {
+	case res = <-ch:
+	case <-clk.After(healthCheckTimeout):
+		res.err = errors.New("timed out listing hosts")
+	}
+	if res.err != nil {
+		l.Log(grohl.Data{"op": "health_check", "at": "list_hosts", "error": res.err})
+		r.WriteHeader(503)
+		return
+	}
+	r.JSON(200, healthStatus{Hosts: res.hosts})
+}
+
 func putFormation(formation ct.Formation, app *ct.App, release *ct.Release, repo *FormationRepo, r ResponseHelper) {
 	formation.AppID = app.ID
 	formation.ReleaseID = release.ID
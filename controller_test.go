@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/flynn/go-sql"
 	"github.com/flynn/rpcplus"
@@ -17,7 +19,9 @@ import (
 
 	ct "github.com/flynn/flynn-controller/types"
 	"github.com/flynn/flynn-controller/utils"
+	"github.com/flynn/flynn-host/types"
 	_ "github.com/flynn/pq"
+	"github.com/technoweenie/grohl"
 	. "github.com/titanous/gocheck"
 )
 
@@ -600,3 +604,203 @@ func (s *S) TestProviderList(c *C) {
 	c.Assert(len(list) > 0, Equals, true)
 	c.Assert(list[0].ID, Not(Equals), "")
 }
+
+func (s *S) TestJSONLogger(c *C) {
+	var buf bytes.Buffer
+	l, err := newLogger("json", &buf)
+	c.Assert(err, IsNil)
+	c.Assert(l.Log(grohl.Data{"op": "run_job", "job_id": "host0-job0", "error": errors.New("boom")}), IsNil)
+
+	var line map[string]interface{}
+	c.Assert(json.Unmarshal(buf.Bytes(), &line), IsNil)
+	c.Assert(line["time"], Not(Equals), nil)
+	delete(line, "time")
+	c.Assert(line, DeepEquals, map[string]interface{}{"op": "run_job", "job_id": "host0-job0", "error": "boom"})
+
+	_, err = newLogger("xml", &buf)
+	c.Assert(err, Not(IsNil))
+}
+
+func (s *S) TestErrorLog(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "error-log"})
+	hostID := utils.UUID()
+	hc := newFakeHostClient()
+	hc.stopErrs["job0"] = errors.New("boom")
+	hc.setJob(&host.ActiveJob{Job: &host.Job{ID: "job0"}, Status: host.StatusRunning})
+	s.cc.setHostClient(hostID, hc)
+	var buf bytes.Buffer
+	logger, err := newLogger("json", &buf)
+	c.Assert(err, IsNil)
+	l := grohl.NewContext(nil)
+	l.Logger = logger
+	s.m.Map(l)
+	defer s.m.Map(grohl.NewContext(grohl.Data{"app": "controller"}))
+
+	req, err := http.NewRequest("DELETE", s.srv.URL+"/apps/"+app.ID+"/jobs/"+hostID+"-job0", nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	req.Header.Set("X-Request-ID", "error-log")
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 500)
+
+	// internal errors are logged with the request's ID
+	dec := json.NewDecoder(&buf)
+	var line map[string]interface{}
+	for line["at"] != "error" {
+		line = nil
+		c.Assert(dec.Decode(&line), IsNil)
+	}
+	c.Assert(line["request_id"], Equals, "error-log")
+	c.Assert(line["error"], Equals, "boom")
+}
+
+func (s *S) TestRequestID(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "request-id"})
+	hostID := utils.UUID()
+	s.cc.setHostClient(hostID, newFakeHostClient())
+	var buf bytes.Buffer
+	logger, err := newLogger("json", &buf)
+	c.Assert(err, IsNil)
+	l := grohl.NewContext(nil)
+	l.Logger = logger
+	s.m.Map(l)
+	defer s.m.Map(grohl.NewContext(grohl.Data{"app": "controller"}))
+
+	del := func(id string) *http.Response {
+		req, err := http.NewRequest("DELETE", s.srv.URL+"/apps/"+app.ID+"/jobs/"+hostID+"-job0", nil)
+		c.Assert(err, IsNil)
+		req.SetBasicAuth("", authKey)
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		return res
+	}
+
+	// the client's ID is echoed and tags the log lines of the request
+	res := del("run-abc.1")
+	c.Assert(res.Header.Get("X-Request-ID"), Equals, "run-abc.1")
+	var line map[string]interface{}
+	c.Assert(json.NewDecoder(&buf).Decode(&line), IsNil)
+	c.Assert(line["request_id"], Equals, "run-abc.1")
+	c.Assert(line["op"], Equals, "kill_job")
+
+	// IDs are made up for clients that don't send a usable one
+	for _, id := range []string{"", "bad id", strings.Repeat("a", 200)} {
+		res := del(id)
+		c.Assert(res.Header.Get("X-Request-ID"), Not(Equals), "")
+		c.Assert(res.Header.Get("X-Request-ID"), Not(Equals), id)
+	}
+}
+
+func (S) TestErrorResponse(c *C) {
+	for _, t := range []struct {
+		err    error
+		status int
+		body   string
+	}{
+		{ErrNotFound, 404, `{"code":"not_found","message":"not found"}`},
+		{ErrNoHosts, 503, `{"code":"no_hosts","message":"no hosts available"}`},
+		{ct.ValidationError{Message: "is invalid"}, 400, `{"code":"validation_error","message":"is invalid"}`},
+		{&JobLimitError{Limit: 2}, 429, `{"code":"job_limit","message":"too many one-off jobs, the limit is 2","detail":{"limit":2}}`},
+		{&UnreachableError{Op: "list hosts", Err: errors.New("refused")}, 502, `{"code":"host_unreachable","message":"list hosts failed: refused"}`},
+		// unexpected errors aren't leaked
+		{errors.New("pq: connection reset"), 500, `{"code":"internal_error","message":"internal error"}`},
+	} {
+		status, body := errorResponse(t.err)
+		c.Assert(status, Equals, t.status)
+		data, err := json.Marshal(body)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, t.body)
+	}
+}
+
+func (S) TestIsJobRoute(c *C) {
+	for path, want := range map[string]bool{
+		"/jobs":                        true,
+		"/apps/foo/jobs":               true,
+		"/apps/foo/jobs/host-job/log":  true,
+		"/apps/foo/runimage":           true,
+		"/hosts/host0/jobs":            true,
+		"/apps":                        false,
+		"/apps/foo":                    false,
+		"/apps/foo/formations/release": false,
+		"/hosts/host0/drain":           false,
+		"/providers/foo/resources":     false,
+	} {
+		c.Assert(isJobRoute(path), Equals, want, Commentf("path %s", path))
+	}
+}
+
+func (s *S) TestHealthCheck(c *C) {
+	defer func(hosts map[string]host.Host, timeout time.Duration) {
+		s.cc.hosts, s.cc.listErr, s.cc.listDelay = hosts, nil, 0
+		healthCheckTimeout = timeout
+	}(s.cc.hosts, healthCheckTimeout)
+	s.cc.setHosts(map[string]host.Host{"host0": {}, "host1": {}})
+
+	// no credentials are needed
+	res, err := http.Get(s.srv.URL + "/healthz")
+	c.Assert(err, IsNil)
+	body, err := s.body(res)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(body, Equals, `{"hosts":2}`)
+
+	// the error is not shown to unauthenticated clients
+	s.cc.listErr = errors.New("connection refused")
+	res, err = http.Get(s.srv.URL + "/healthz")
+	c.Assert(err, IsNil)
+	body, err = s.body(res)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 503)
+	c.Assert(body, Equals, "")
+
+	s.cc.listErr = nil
+	s.cc.listDelay = 100 * time.Millisecond
+	healthCheckTimeout = 10 * time.Millisecond
+	res, err = http.Get(s.srv.URL + "/healthz")
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 503)
+}
+
+func (s *S) TestParseJobEnv(c *C) {
+	env := parseJobEnv([]string{
+		"PATH=/bin",
+		"DEFAULT_JOB_ENV_TRACE_URL=http://trace:8080/?a=b",
+		"DEFAULT_JOB_ENV_EMPTY=",
+		"DEFAULT_JOB_ENV_=ignored",
+		"DEFAULT_JOB_ENV_INVALID",
+	})
+	c.Assert(env, DeepEquals, map[string]string{"TRACE_URL": "http://trace:8080/?a=b", "EMPTY": ""})
+}
+
+func (s *S) TestCheckAccept(c *C) {
+	supported := []string{"application/json", "text/event-stream"}
+	for _, t := range []struct {
+		accept string
+		ok     bool
+	}{
+		{"", true},
+		{"application/json", true},
+		{"Text/Event-Stream", true},
+		{"text/html, application/json;q=0.9", true},
+		{"text/*", true},
+		{"*/*", true},
+		{"text/html", false},
+		{"image/*", false},
+		{"application/json;q=0", false},
+	} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if t.accept != "" {
+			req.Header.Set("Accept", t.accept)
+		}
+		err := checkAccept(req, supported...)
+		c.Assert(err == nil, Equals, t.ok, Commentf("accept = %q", t.accept))
+	}
+}
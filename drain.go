@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-controller/utils"
+	"github.com/flynn/flynn-host/types"
+	"github.com/flynn/go-flynn/cluster"
+	"github.com/go-martini/martini"
+	"github.com/technoweenie/grohl"
+)
+
+// jobMigratableAttr is the job attribute that is set to "false" for jobs
+// that must not be moved to another host when their host is drained.
+const jobMigratableAttr = "flynn-controller.migratable"
+
+// drainStartTimeout is how long the replacement jobs of a drain have to start
+// running, the jobs that they replace are left alone if they don't.
+var drainStartTimeout = 30 * time.Second
+
+// hostCordons is a clusterClient that reports the hosts the controller has
+// cordoned as draining, so that nothing it schedules lands on them. Cordons
+// last until the controller restarts, operators set hostDrainAttr to keep a
+// host empty for longer.
+type hostCordons struct {
+	clusterClient
+
+	mtx   sync.Mutex
+	hosts map[string]struct{}
+}
+
+func newHostCordons(cc clusterClient) *hostCordons {
+	return &hostCordons{clusterClient: cc, hosts: make(map[string]struct{})}
+}
+
+func (c *hostCordons) cordon(hostID string) {
+	c.mtx.Lock()
+	c.hosts[hostID] = struct{}{}
+	c.mtx.Unlock()
+}
+
+func (c *hostCordons) ListHosts() (map[string]host.Host, error) {
+	hosts, err := c.clusterClient.ListHosts()
+	if err != nil {
+		return nil, err
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	res := make(map[string]host.Host, len(hosts))
+	for id, h := range hosts {
+		if _, ok := c.hosts[id]; ok && !hostDraining(h) {
+			attrs := make(map[string]string, len(h.Attributes)+1)
+			for k, v := range h.Attributes {
+				attrs[k] = v
+			}
+			attrs[hostDrainAttr] = "true"
+			h.Attributes = attrs
+		}
+		res[id] = h
+	}
+	return res, nil
+}
+
+// drainMove is a job that is being replaced by a copy on another host.
+type drainMove struct {
+	id  string
+	job *host.Job
+	p   jobPlacement
+	err error
+}
+
+// drainHost moves the jobs on a host to other hosts. The host is cordoned
+// first so that nothing new is scheduled on it. Each job is replaced by a copy
+// that is started elsewhere, the original is only stopped once the copy is
+// running. It only suits jobs that don't keep state on their host.
+func drainHost(params martini.Params, cl clusterClient, cordons *hostCordons, sched scheduler, clk clock, l *grohl.Context, r ResponseHelper) {
+	hostID := params["hosts_id"]
+	l = l.New(grohl.Data{"op": "drain_host", "host_id": hostID})
+	hosts, err := cl.ListHosts()
+	if err != nil {
+		r.Error(upstreamFailure("", "list hosts", err))
+		return
+	}
+	h, ok := hosts[hostID]
+	if !ok {
+		r.Error(ErrNotFound)
+		return
+	}
+	cordons.cordon(hostID)
+	l.Log(grohl.Data{"at": "cordon"})
+	pool := schedulableHosts(hosts)
+	delete(pool, hostID)
+
+	jobs := make([]*host.Job, len(h.Jobs))
+	copy(jobs, h.Jobs)
+	sort.Sort(jobsByID(jobs))
+
+	res := &ct.DrainHostResult{
+		Moved:   make(map[string]string),
+		Skipped: make(map[string]string),
+		Failed:  make(map[string]string),
+	}
+	var moves []*drainMove
+	for _, j := range jobs {
+		id := utils.FormatJobID(hostID, j.ID)
+		if reason := drainSkipReason(j); reason != "" {
+			res.Skipped[id] = reason
+			continue
+		}
+		replacement := drainReplacement(j)
+		candidates := freePortHosts(pool, hostPorts(j))
+		if len(candidates) == 0 {
+			res.Failed[id] = ErrNoHosts.Error()
+			continue
+		}
+		placements, err := placeJobs(sched, candidates, []*host.Job{replacement})
+		if err == nil {
+			placements, err = addJobsWithRetry(l, cl, clk, sched, candidates, placements)
+		}
+		if err != nil {
+			res.Failed[id] = err.Error()
+			continue
+		}
+		p := placements[0]
+		// later jobs are spread out with the replacements in mind
+		pool[p.HostID] = candidates[p.HostID]
+		moves = append(moves, &drainMove{id: id, job: j, p: p})
+	}
+
+	// the replacements start side by side, against one deadline
+	startDeadline := clk.Now().Add(drainStartTimeout)
+	var wg sync.WaitGroup
+	for _, m := range moves {
+		wg.Add(1)
+		go func(m *drainMove) {
+			defer wg.Done()
+			m.err = waitReplacement(cl, clk, m.p, startDeadline)
+		}(m)
+	}
+	wg.Wait()
+
+	var client cluster.Host
+	for _, m := range moves {
+		id, j, p := m.id, m.job, m.p
+		newID := utils.FormatJobID(p.HostID, p.Job.ID)
+		if m.err != nil {
+			l.Log(grohl.Data{"at": "replacement_failed", "job_id": j.ID, "new_host_id": p.HostID, "new_job_id": p.Job.ID, "error": m.err})
+			res.Failed[id] = "replacement " + newID + " did not start: " + m.err.Error()
+			continue
+		}
+		l.Log(grohl.Data{"at": "moved", "job_id": j.ID, "new_host_id": p.HostID, "new_job_id": p.Job.ID})
+		if deadline, err := time.Parse(time.RFC3339, j.Attributes["flynn-controller.deadline"]); err == nil {
+			go watchJobTimeout(l.New(grohl.Data{"op": "job_timeout", "host_id": p.HostID, "job_id": p.Job.ID}), cl, clk, p.HostID, p.Job.ID, deadline.Sub(clk.Now()))
+		}
+
+		if client == nil {
+			if client, err = cl.DialHost(hostID); err != nil {
+				client = nil
+				res.Failed[id] = "replaced by " + newID + " but not stopped: " + err.Error()
+				continue
+			}
+			defer client.Close()
+		}
+		if err := client.StopJob(j.ID); err != nil {
+			res.Failed[id] = "replaced by " + newID + " but not stopped: " + err.Error()
+			continue
+		}
+		res.Moved[id] = newID
+	}
+	l.Log(grohl.Data{"moved": len(res.Moved), "skipped": len(res.Skipped), "failed": len(res.Failed)})
+	r.JSON(200, res)
+}
+
+// waitReplacement waits for the host of a replacement job to report that it
+// is running. A replacement that is still starting at the deadline is stopped
+// so that the job doesn't end up running twice.
+func waitReplacement(cl clusterClient, clk clock, p jobPlacement, deadline time.Time) error {
+	client, err := cl.DialHost(p.HostID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	for {
+		job, err := client.GetJob(p.Job.ID)
+		if err != nil {
+			return err
+		}
+		if job != nil {
+			switch job.Status {
+			case host.StatusRunning:
+				return nil
+			case host.StatusDone, host.StatusCrashed, host.StatusFailed:
+				return errors.New("it exited before it was running")
+			}
+		}
+		if !clk.Now().Before(deadline) {
+			client.StopJob(p.Job.ID)
+			return errors.New("timed out waiting for it to run")
+		}
+		<-clk.After(jobExitPollInterval)
+	}
+}
+
+// drainSkipReason returns why a job is left on a host that is being drained,
+// or "" if it can be moved.
+func drainSkipReason(j *host.Job) string {
+	switch {
+	case j.Attributes["flynn-controller.app"] == "":
+		return "was not started by the controller"
+	case j.Attributes[jobMigratableAttr] == "false":
+		return "is not migratable"
+	case j.Config == nil:
+		return "has no config"
+	case j.Config.OpenStdin:
+		return "has stdin attached"
+	}
+	switch jobState(j) {
+	case ct.JobStateDown, ct.JobStateCrashed:
+		return "is not running"
+	}
+	return ""
+}
+
+// drainReplacement returns a copy of a job to start on another host, without
+// the attributes that its old host set. Attributes that the controller owns
+// are kept.
+func drainReplacement(j *host.Job) *host.Job {
+	replacement := replicateJob(j)
+	for k := range replacement.Attributes {
+		if strings.HasPrefix(k, "flynn-host.") {
+			delete(replacement.Attributes, k)
+		}
+	}
+	return replacement
+}
+
+type jobsByID []*host.Job
+
+func (j jobsByID) Len() int           { return len(j) }
+func (j jobsByID) Less(a, b int) bool { return j[a].ID < j[b].ID }
+func (j jobsByID) Swap(a, b int)      { j[a], j[b] = j[b], j[a] }
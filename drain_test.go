@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-host/types"
+	"github.com/flynn/go-dockerclient"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) TestDrainHost(c *C) {
+	hc := newFakeHostClient()
+	s.cc.setHostClient("drained", hc)
+	// the replacements start running straight away
+	other := newFakeHostClient()
+	other.getJobFunc = func(id string) *host.ActiveJob {
+		return &host.ActiveJob{Job: &host.Job{ID: id}, Status: host.StatusRunning}
+	}
+	s.cc.setHostClient("other", other)
+	job := func(id string, attrs map[string]string) *host.Job {
+		a := map[string]string{"flynn-controller.app": "app0", "flynn-host.state": "up"}
+		for k, v := range attrs {
+			a[k] = v
+		}
+		return &host.Job{ID: id, Attributes: a, Config: &docker.Config{Cmd: []string{"sleep", "60"}}}
+	}
+	stdin := job("stdin", nil)
+	stdin.Config.OpenStdin = true
+	s.cc.setHosts(map[string]host.Host{
+		"drained": {ID: "drained", Jobs: []*host.Job{
+			job("web", map[string]string{"flynn-controller.type": "web"}),
+			job("oneoff", nil),
+			job("pinned", map[string]string{jobMigratableAttr: "false"}),
+			job("exited", map[string]string{"flynn-host.state": "down"}),
+			stdin,
+			{ID: "system", Config: &docker.Config{}},
+		}},
+		"other": {ID: "other"},
+		// new jobs aren't moved to hosts that are being drained themselves
+		"draining": {ID: "draining", Attributes: map[string]string{hostDrainAttr: "true"}},
+	})
+
+	var res ct.DrainHostResult
+	_, err := s.Post("/hosts/drained/drain", nil, &res)
+	c.Assert(err, IsNil)
+	c.Assert(res.Failed, HasLen, 0)
+	c.Assert(res.Skipped, DeepEquals, map[string]string{
+		"drained-pinned": "is not migratable",
+		"drained-exited": "is not running",
+		"drained-stdin":  "has stdin attached",
+		"drained-system": "was not started by the controller",
+	})
+	c.Assert(res.Moved, HasLen, 2)
+
+	moved := s.cc.hosts["other"].Jobs
+	c.Assert(moved, HasLen, 2)
+	for _, j := range moved {
+		c.Assert(j.Attributes["flynn-controller.app"], Equals, "app0")
+		_, ok := j.Attributes["flynn-host.state"]
+		c.Assert(ok, Equals, false)
+		c.Assert(j.Config.Cmd, DeepEquals, []string{"sleep", "60"})
+	}
+	c.Assert(res.Moved["drained-oneoff"], Equals, "other-"+moved[0].ID)
+	c.Assert(res.Moved["drained-web"], Equals, "other-"+moved[1].ID)
+	c.Assert(moved[1].Attributes["flynn-controller.type"], Equals, "web")
+	c.Assert(s.cc.hosts["draining"].Jobs, HasLen, 0)
+	c.Assert(hc.isStopped("oneoff"), Equals, true)
+	c.Assert(hc.isStopped("web"), Equals, true)
+	c.Assert(hc.isStopped("pinned"), Equals, false)
+
+	// the drained host is cordoned
+	app := s.createTestApp(c, &ct.App{Name: "drain-cordon"})
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://foo/bar"})
+	release := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+	r, err := s.Post(fmt.Sprintf("/apps/%s/jobs", app.ID), &ct.NewJob{ReleaseID: release.ID, HostID: "drained", Cmd: []string{"true"}}, nil)
+	c.Assert(err, IsNil)
+	r.Body.Close()
+	c.Assert(r.StatusCode, Equals, 422)
+
+	// jobs whose replacements don't run are left running
+	other.getJobFunc = func(id string) *host.ActiveJob {
+		return &host.ActiveJob{Job: &host.Job{ID: id}, Status: host.StatusFailed}
+	}
+	s.cc.setHosts(map[string]host.Host{
+		"drained": {ID: "drained", Jobs: []*host.Job{job("broken", nil)}},
+		"other":   {ID: "other"},
+	})
+	res = ct.DrainHostResult{}
+	_, err = s.Post("/hosts/drained/drain", nil, &res)
+	c.Assert(err, IsNil)
+	c.Assert(res.Moved, HasLen, 0)
+	c.Assert(res.Failed, HasLen, 1)
+	c.Assert(strings.HasSuffix(res.Failed["drained-broken"], "did not start: it exited before it was running"), Equals, true)
+	c.Assert(hc.isStopped("broken"), Equals, false)
+
+	// jobs that can't be placed are left running
+	s.cc.setHosts(map[string]host.Host{
+		"drained": {ID: "drained", Jobs: []*host.Job{job("lonely", nil)}},
+	})
+	res = ct.DrainHostResult{}
+	_, err = s.Post("/hosts/drained/drain", nil, &res)
+	c.Assert(err, IsNil)
+	c.Assert(res.Failed, DeepEquals, map[string]string{"drained-lonely": "no hosts available"})
+	c.Assert(hc.isStopped("lonely"), Equals, false)
+
+	r, err = s.Post("/hosts/nonexistent/drain", nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, 404)
+}
+
+func (s *S) TestDrainHostStartDeadline(c *C) {
+	clk := newFakeClock()
+	s.m.MapTo(clk, (*clock)(nil))
+	defer s.m.MapTo(realClock{}, (*clock)(nil))
+
+	hc := newFakeHostClient()
+	s.cc.setHostClient("slow-drained", hc)
+	// the replacements never get past starting
+	other := newFakeHostClient()
+	other.getJobFunc = func(id string) *host.ActiveJob {
+		return &host.ActiveJob{Job: &host.Job{ID: id}, Status: host.StatusStarting}
+	}
+	s.cc.setHostClient("slow-other", other)
+	job := func(id string) *host.Job {
+		return &host.Job{ID: id, Attributes: map[string]string{"flynn-controller.app": "app0"}, Config: &docker.Config{}}
+	}
+	s.cc.setHosts(map[string]host.Host{
+		"slow-drained": {ID: "slow-drained", Jobs: []*host.Job{job("a"), job("b")}},
+		"slow-other":   {ID: "slow-other"},
+	})
+
+	done := make(chan ct.DrainHostResult)
+	go func() {
+		var res ct.DrainHostResult
+		_, err := s.Post("/hosts/slow-drained/drain", nil, &res)
+		c.Assert(err, IsNil)
+		done <- res
+	}()
+	// both replacements are waited on at once, so one timeout covers them
+	for i := 0; i < 100 && clk.Waiting() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(clk.Waiting(), Equals, 2)
+	clk.Advance(drainStartTimeout)
+	res := <-done
+
+	c.Assert(res.Moved, HasLen, 0)
+	c.Assert(res.Failed, HasLen, 2)
+	for _, id := range []string{"slow-drained-a", "slow-drained-b"} {
+		c.Assert(strings.HasSuffix(res.Failed[id], "did not start: timed out waiting for it to run"), Equals, true, Commentf("id = %s", id))
+	}
+	for _, j := range s.cc.hosts["slow-other"].Jobs {
+		c.Assert(other.isStopped(j.ID), Equals, true)
+	}
+	c.Assert(hc.isStopped("a"), Equals, false)
+	c.Assert(hc.isStopped("b"), Equals, false)
+}
+
+func (S) TestHostCordons(c *C) {
+	cc := newFakeCluster()
+	cc.setHosts(map[string]host.Host{
+		"host0": {ID: "host0", Attributes: map[string]string{"foo": "bar"}},
+		"host1": {ID: "host1"},
+	})
+	cordons := newHostCordons(cc)
+	cordons.cordon("host0")
+	hosts, err := cordons.ListHosts()
+	c.Assert(err, IsNil)
+	c.Assert(hosts["host0"].Attributes, DeepEquals, map[string]string{"foo": "bar", hostDrainAttr: "true"})
+	c.Assert(hostDraining(hosts["host1"]), Equals, false)
+	// the cluster's own view is left alone
+	c.Assert(cc.hosts["host0"].Attributes, DeepEquals, map[string]string{"foo": "bar"})
+}
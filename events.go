@@ -0,0 +1,290 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-controller/utils"
+	"github.com/flynn/flynn-host/types"
+	"github.com/flynn/go-flynn/cluster"
+	"github.com/technoweenie/grohl"
+)
+
+// jobEventPollInterval is how often jobEvents looks for job state changes.
+var jobEventPollInterval = time.Second
+
+// jobEvents streams an event each time one of the app's jobs changes state.
+// The current state of all of the jobs is sent first.
+func jobEvents(app *ct.App, cc clusterClient, conf *logConfig, sessions *sessionRegistry, clk clock, l *grohl.Context, w http.ResponseWriter, r ResponseHelper) {
+	hosts, err := cc.ListHosts()
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	l = l.New(grohl.Data{"op": "job_events", "app_id": app.ID})
+
+	es := openEventStream(w, conf, sessions, clk)
+	defer es.close()
+	ssew := es.SSELogWriter
+
+	states := appJobStates(hosts, app.ID)
+	for _, id := range states.ids() {
+		s := states[id]
+		if err := ssew.Event("job", &ct.JobEvent{JobID: id, Type: s.typ, State: s.state}); err != nil {
+			return
+		}
+	}
+
+	ticker := clk.NewTicker(jobEventPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			hosts, err := cc.ListHosts()
+			if err != nil {
+				l.Log(grohl.Data{"at": "list_hosts", "error": err})
+				continue
+			}
+			next := appJobStates(hosts, app.ID)
+			for _, e := range jobStateChanges(states, next) {
+				if e.State == ct.JobStateDown || e.State == ct.JobStateCrashed {
+					addJobExit(cc, e)
+				}
+				if err := ssew.Event("job", e); err != nil {
+					return
+				}
+			}
+			states = next
+		case <-es.gone:
+			return
+		case <-es.shutdown:
+			ssew.Event("eof", struct{}{})
+			return
+		}
+	}
+}
+
+// eventStream is a server-sent event response that is kept alive while it is
+// open. gone is closed if the client goes away and shutdown is closed when
+// the controller is shutting down.
+type eventStream struct {
+	SSELogWriter
+	gone, shutdown <-chan struct{}
+	close          func()
+}
+
+func openEventStream(w http.ResponseWriter, conf *logConfig, sessions *sessionRegistry, clk clock) *eventStream {
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	ssew := NewSSELogWriter(w, clk, false)
+	shutdown := make(chan struct{})
+	done := sessions.add(func() { close(shutdown) })
+
+	stop, gone := make(chan struct{}), make(chan struct{})
+	var goneOnce sync.Once
+	setGone := func() { goneOnce.Do(func() { close(gone) }) }
+	go func() {
+		if err := ssew.KeepAlive(conf.keepAlive, stop); err != nil {
+			setGone()
+		}
+	}()
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closeNotify := cn.CloseNotify()
+		go func() {
+			select {
+			case <-closeNotify:
+				setGone()
+			case <-stop:
+			}
+		}()
+	}
+	return &eventStream{
+		SSELogWriter: ssew,
+		gone:         gone,
+		shutdown:     shutdown,
+		close: func() {
+			close(stop)
+			done()
+		},
+	}
+}
+
+// jobProgressPoll is how often streamJobProgress checks on the jobs that it
+// reports on.
+var jobProgressPoll = 500 * time.Millisecond
+
+// streamJobProgress sends an event each time one of a set of jobs that have
+// just been scheduled gets further towards running, until they are all up or
+// have stopped.
+func streamJobProgress(cc clusterClient, hostConf *hostConfig, conf *logConfig, sessions *sessionRegistry, clk clock, l *grohl.Context, w http.ResponseWriter, jobs []*ct.Job) {
+	es := openEventStream(w, conf, sessions, clk)
+	defer es.close()
+
+	clients := make(map[string]cluster.Host)
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+	states := make(map[string]string, len(jobs))
+	for _, j := range jobs {
+		states[j.ID] = ct.JobStateScheduled
+		if err := es.Event("job", &ct.JobEvent{JobID: j.ID, Type: j.Type, State: ct.JobStateScheduled}); err != nil {
+			return
+		}
+	}
+
+	ticker := clk.NewTicker(jobProgressPoll)
+	defer ticker.Stop()
+	for pending := len(jobs); pending > 0; {
+		select {
+		case <-ticker.C():
+		case <-es.gone:
+			return
+		case <-es.shutdown:
+			pending = 0
+			continue
+		}
+		for _, j := range jobs {
+			if progressDone(states[j.ID]) {
+				continue
+			}
+			client, ok := clients[j.HostID]
+			if !ok {
+				var err error
+				if client, err = dialHost(cc, j.HostID, hostConf); err != nil {
+					l.Log(grohl.Data{"at": "dial_host", "host_id": j.HostID, "error": err})
+					continue
+				}
+				clients[j.HostID] = client
+			}
+			active, err := client.GetJob(j.JobID)
+			if err != nil {
+				l.Log(grohl.Data{"at": "get_job", "host_id": j.HostID, "job_id": j.JobID, "error": err})
+				continue
+			}
+			e := jobProgress(j, active)
+			if e == nil || e.State == states[j.ID] {
+				continue
+			}
+			states[j.ID] = e.State
+			if progressDone(e.State) {
+				pending--
+			}
+			if err := es.Event("job", e); err != nil {
+				return
+			}
+		}
+	}
+	es.Event("eof", struct{}{})
+}
+
+// jobProgress describes how far a job has got. Jobs are pulling their image
+// until the host has created a container for them. It returns nil if the host
+// does not know about the job yet.
+func jobProgress(j *ct.Job, active *host.ActiveJob) *ct.JobEvent {
+	if active == nil {
+		return nil
+	}
+	e := &ct.JobEvent{JobID: j.ID, Type: j.Type, State: activeJobState(active)}
+	switch active.Status {
+	case host.StatusStarting:
+		if active.ContainerID == "" {
+			e.State = ct.JobStatePulling
+		}
+	case host.StatusDone, host.StatusCrashed:
+		e.ExitCode = &active.ExitCode
+	}
+	if active.Error != nil {
+		e.Reason = *active.Error
+	}
+	return e
+}
+
+func progressDone(state string) bool {
+	return state == ct.JobStateUp || state == ct.JobStateDown || state == ct.JobStateCrashed
+}
+
+type jobStatus struct {
+	typ, state string
+}
+
+type jobStates map[string]jobStatus
+
+func appJobStates(hosts map[string]host.Host, appID string) jobStates {
+	states := make(jobStates)
+	for _, h := range hosts {
+		for _, j := range h.Jobs {
+			if j.Attributes["flynn-controller.app"] != appID {
+				continue
+			}
+			states[utils.FormatJobID(h.ID, j.ID)] = jobStatus{
+				typ:   j.Attributes["flynn-controller.type"],
+				state: jobState(j),
+			}
+		}
+	}
+	return states
+}
+
+func (s jobStates) ids() []string {
+	ids := make([]string, 0, len(s))
+	for id := range s {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// jobStateChanges returns events for the jobs that have been scheduled, have
+// changed state or have gone away between prev and next.
+func jobStateChanges(prev, next jobStates) []*ct.JobEvent {
+	var events []*ct.JobEvent
+	for _, id := range next.ids() {
+		s := next[id]
+		p, ok := prev[id]
+		if ok && p.state == s.state {
+			continue
+		}
+		e := &ct.JobEvent{JobID: id, Type: s.typ, State: s.state}
+		if !ok {
+			e.Reason = "scheduled"
+		}
+		events = append(events, e)
+	}
+	for _, id := range prev.ids() {
+		if _, ok := next[id]; ok {
+			continue
+		}
+		p := prev[id]
+		if p.state == ct.JobStateDown || p.state == ct.JobStateCrashed {
+			// the stop has already been reported
+			continue
+		}
+		events = append(events, &ct.JobEvent{JobID: id, Type: p.typ, State: ct.JobStateDown, Reason: "removed"})
+	}
+	return events
+}
+
+// addJobExit adds the exit code and error of a job that has stopped to e, if
+// the host still knows about it.
+func addJobExit(cc clusterClient, e *ct.JobEvent) {
+	hostID, jobID := utils.ParseJobID(e.JobID)
+	client, err := cc.DialHost(hostID)
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	job, err := client.GetJob(jobID)
+	if err != nil || job == nil {
+		return
+	}
+	if job.Status == host.StatusDone || job.Status == host.StatusCrashed {
+		e.ExitCode = &job.ExitCode
+	}
+	if job.Error != nil {
+		e.Reason = *job.Error
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-controller/utils"
+	"github.com/flynn/flynn-host/types"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) TestJobStateChanges(c *C) {
+	prev := jobStates{
+		"host0-job0": {typ: "web", state: ct.JobStateUp},
+		"host0-job1": {typ: "web", state: ct.JobStateUp},
+		"host0-job2": {state: ct.JobStateUp},
+		"host0-job3": {state: ct.JobStateCrashed},
+	}
+	next := jobStates{
+		"host0-job0": {typ: "web", state: ct.JobStateUp},
+		"host0-job1": {typ: "web", state: ct.JobStateCrashed},
+		"host1-job4": {typ: "worker", state: ct.JobStateStarting},
+	}
+	c.Assert(jobStateChanges(prev, next), DeepEquals, []*ct.JobEvent{
+		{JobID: "host0-job1", Type: "web", State: ct.JobStateCrashed},
+		{JobID: "host1-job4", Type: "worker", State: ct.JobStateStarting, Reason: "scheduled"},
+		{JobID: "host0-job2", State: ct.JobStateDown, Reason: "removed"},
+	})
+}
+
+func (s *S) TestJobEvents(c *C) {
+	defer func(d time.Duration) { jobEventPollInterval = d }(jobEventPollInterval)
+	jobEventPollInterval = 10 * time.Millisecond
+
+	app := s.createTestApp(c, &ct.App{Name: "job-events"})
+	jobAttrs := func(state string) map[string]string {
+		return map[string]string{"flynn-controller.app": app.ID, "flynn-controller.type": "web", "flynn-host.state": state}
+	}
+	s.cc.setHosts(map[string]host.Host{"host0": {ID: "host0", Jobs: []*host.Job{
+		{ID: "job0", Attributes: jobAttrs(ct.JobStateUp)},
+		{ID: "other", Attributes: map[string]string{"flynn-controller.app": "otherApp"}},
+	}}})
+	hc := newFakeHostClient()
+	msg := "exit status 2"
+	hc.setJob(&host.ActiveJob{Job: &host.Job{ID: "job0"}, Status: host.StatusCrashed, ExitCode: 2, Error: &msg})
+	s.cc.setHostClient("host0", hc)
+
+	req, err := http.NewRequest("GET", s.srv.URL+"/apps/"+app.ID+"/jobs/events", nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("Content-Type"), Equals, "text/event-stream; charset=utf-8")
+
+	br := bufio.NewReader(res.Body)
+	readEvent := func() string {
+		var lines []string
+		for {
+			line, err := br.ReadString('\n')
+			c.Assert(err, IsNil)
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+	c.Assert(readEvent(), Equals, "event: job\ndata: {\"job_id\":\"host0-job0\",\"type\":\"web\",\"state\":\"up\"}\n")
+
+	s.cc.setHosts(map[string]host.Host{"host0": {ID: "host0", Jobs: []*host.Job{
+		{ID: "job0", Attributes: jobAttrs(ct.JobStateCrashed)},
+		{ID: "job1", Attributes: jobAttrs(ct.JobStateStarting)},
+	}}})
+	c.Assert(readEvent(), Equals, "event: job\ndata: {\"job_id\":\"host0-job0\",\"type\":\"web\",\"state\":\"crashed\",\"reason\":\"exit status 2\",\"exit_code\":2}\n")
+	c.Assert(readEvent(), Equals, "event: job\ndata: {\"job_id\":\"host0-job1\",\"type\":\"web\",\"state\":\"starting\",\"reason\":\"scheduled\"}\n")
+}
+
+func (s *S) TestRunJobProgress(c *C) {
+	defer func(d time.Duration) { jobProgressPoll = d }(jobProgressPoll)
+	jobProgressPoll = 10 * time.Millisecond
+
+	app := s.createTestApp(c, &ct.App{Name: "run-progress"})
+	hostID := utils.UUID()
+	s.cc.setHosts(map[string]host.Host{hostID: {ID: hostID}})
+	hc := newFakeHostClient()
+	// the host goes through a state on each poll
+	progress := []*host.ActiveJob{
+		nil,
+		{Status: host.StatusStarting},
+		{Status: host.StatusStarting},
+		{Status: host.StatusStarting, ContainerID: "container0"},
+		{Status: host.StatusRunning, ContainerID: "container0"},
+	}
+	var polls int
+	hc.getJobFunc = func(id string) *host.ActiveJob {
+		job := progress[len(progress)-1]
+		if polls < len(progress) {
+			job = progress[polls]
+		}
+		polls++
+		return job
+	}
+	s.cc.setHostClient(hostID, hc)
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://foo/bar"})
+	release := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+
+	data, _ := json.Marshal(&ct.NewJob{ReleaseID: release.ID, Cmd: []string{"true"}})
+	req, err := http.NewRequest("POST", s.srv.URL+"/apps/"+app.ID+"/jobs", bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("Content-Type"), Equals, "text/event-stream; charset=utf-8")
+	body, err := s.body(res)
+	c.Assert(err, IsNil)
+
+	id := hostID + "-" + s.cc.hosts[hostID].Jobs[0].ID
+	event := func(state string) string {
+		return fmt.Sprintf("event: job\ndata: {\"job_id\":%q,\"state\":%q}\n\n", id, state)
+	}
+	c.Assert(body, Equals, event("scheduled")+event("pulling")+event("starting")+event("up")+"event: eof\ndata: {}\n\n")
+}
+
+func (S) TestJobProgress(c *C) {
+	job := &ct.Job{ID: "host0-job0", Type: "web"}
+	msg := "exit status 1"
+	for _, t := range []struct {
+		active *host.ActiveJob
+		event  *ct.JobEvent
+	}{
+		{nil, nil},
+		{&host.ActiveJob{Status: host.StatusStarting}, &ct.JobEvent{State: "pulling"}},
+		{&host.ActiveJob{Status: host.StatusStarting, ContainerID: "c"}, &ct.JobEvent{State: "starting"}},
+		{&host.ActiveJob{Status: host.StatusRunning, ContainerID: "c"}, &ct.JobEvent{State: "up"}},
+		{&host.ActiveJob{Status: host.StatusDone, ContainerID: "c"}, &ct.JobEvent{State: "down", ExitCode: new(int)}},
+		{&host.ActiveJob{Status: host.StatusCrashed, ContainerID: "c", ExitCode: 1, Error: &msg}, &ct.JobEvent{State: "crashed", Reason: msg, ExitCode: &[]int{1}[0]}},
+		{&host.ActiveJob{Status: host.StatusFailed, Error: &msg}, &ct.JobEvent{State: "crashed", Reason: msg}},
+	} {
+		if t.event != nil {
+			t.event.JobID, t.event.Type = job.ID, job.Type
+		}
+		c.Assert(jobProgress(job, t.active), DeepEquals, t.event)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn-host/types"
+	"github.com/flynn/go-flynn/cluster"
+	"github.com/flynn/rpcplus"
+)
+
+// defaultHostPoolIdleTimeout is how long an unused host connection is kept
+// open for reuse.
+const defaultHostPoolIdleTimeout = time.Minute
+
+// maxIdleHostConns is the most unused connections that are kept for a host.
+const maxIdleHostConns = 4
+
+// hostPool is a clusterClient that reuses host connections. Each handle
+// returned by DialHost is used by one caller at a time and goes back in the
+// pool when it is closed, unless the connection has failed.
+type hostPool struct {
+	clusterClient
+	idleTimeout time.Duration
+	clock       clock
+
+	mtx    sync.Mutex
+	idle   map[string][]idleHost
+	closed bool
+	stop   chan struct{}
+}
+
+type idleHost struct {
+	client cluster.Host
+	since  time.Time
+}
+
+func newHostPool(cc clusterClient, idleTimeout time.Duration, clk clock) *hostPool {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultHostPoolIdleTimeout
+	}
+	p := &hostPool{
+		clusterClient: cc,
+		idleTimeout:   idleTimeout,
+		clock:         clk,
+		idle:          make(map[string][]idleHost),
+		stop:          make(chan struct{}),
+	}
+	go p.evictLoop()
+	return p
+}
+
+func (p *hostPool) DialHost(id string) (cluster.Host, error) {
+	p.mtx.Lock()
+	if conns := p.idle[id]; len(conns) > 0 {
+		// the most recently used connection is the least likely to have
+		// been dropped
+		c := conns[len(conns)-1]
+		p.idle[id] = conns[:len(conns)-1]
+		p.mtx.Unlock()
+		return &pooledHost{Host: c.client, pool: p, hostID: id}, nil
+	}
+	p.mtx.Unlock()
+
+	client, err := p.clusterClient.DialHost(id)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledHost{Host: client, pool: p, hostID: id}, nil
+}
+
+func (p *hostPool) put(id string, client cluster.Host) {
+	p.mtx.Lock()
+	if p.closed || len(p.idle[id]) >= maxIdleHostConns {
+		p.mtx.Unlock()
+		client.Close()
+		return
+	}
+	p.idle[id] = append(p.idle[id], idleHost{client, p.clock.Now()})
+	p.mtx.Unlock()
+}
+
+func (p *hostPool) evictLoop() {
+	for {
+		select {
+		case <-p.clock.After(p.idleTimeout / 2):
+			p.evict(p.clock.Now().Add(-p.idleTimeout))
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// evict closes the connections that have been idle since before cutoff.
+func (p *hostPool) evict(cutoff time.Time) {
+	var expired []cluster.Host
+	p.mtx.Lock()
+	for id, conns := range p.idle {
+		// conns are in the order that they were returned
+		n := 0
+		for n < len(conns) && conns[n].since.Before(cutoff) {
+			expired = append(expired, conns[n].client)
+			n++
+		}
+		if n == len(conns) {
+			delete(p.idle, id)
+		} else {
+			p.idle[id] = conns[n:]
+		}
+	}
+	p.mtx.Unlock()
+	for _, client := range expired {
+		client.Close()
+	}
+}
+
+// Close closes the idle connections, handles that are in use close their
+// connections when they are done with.
+func (p *hostPool) Close() error {
+	p.mtx.Lock()
+	if p.closed {
+		p.mtx.Unlock()
+		return nil
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mtx.Unlock()
+	close(p.stop)
+	for _, conns := range idle {
+		for _, c := range conns {
+			c.client.Close()
+		}
+	}
+	return nil
+}
+
+// pooledHost is a host connection borrowed from a hostPool.
+type pooledHost struct {
+	cluster.Host
+	pool   *hostPool
+	hostID string
+
+	mtx    sync.Mutex
+	broken bool
+	done   bool
+}
+
+func (h *pooledHost) ListJobs() (map[string]host.ActiveJob, error) {
+	jobs, err := h.Host.ListJobs()
+	h.check(err)
+	return jobs, err
+}
+
+func (h *pooledHost) GetJob(id string) (*host.ActiveJob, error) {
+	job, err := h.Host.GetJob(id)
+	h.check(err)
+	return job, err
+}
+
+func (h *pooledHost) StopJob(id string) error {
+	err := h.Host.StopJob(id)
+	h.check(err)
+	return err
+}
+
+func (h *pooledHost) Attach(req *host.AttachReq, wait bool) (cluster.ReadWriteCloser, func() error, error) {
+	rwc, waitFn, err := h.Host.Attach(req, wait)
+	h.check(err)
+	return rwc, waitFn, err
+}
+
+// check marks the connection as broken if err means that it has failed, so
+// that it is closed rather than reused.
+func (h *pooledHost) check(err error) {
+	if !hostConnError(err) {
+		return
+	}
+	h.mtx.Lock()
+	h.broken = true
+	h.mtx.Unlock()
+}
+
+func (h *pooledHost) Close() error {
+	h.mtx.Lock()
+	done, broken := h.done, h.broken
+	h.done = true
+	h.mtx.Unlock()
+	if done {
+		return nil
+	}
+	if broken {
+		return h.Host.Close()
+	}
+	h.pool.put(h.hostID, h.Host)
+	return nil
+}
+
+func hostConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF || err == rpcplus.ErrShutdown
+}
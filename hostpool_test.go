@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn-host/types"
+	"github.com/flynn/go-flynn/cluster"
+	. "github.com/titanous/gocheck"
+)
+
+type poolTestCluster struct {
+	clusterClient
+	mtx   sync.Mutex
+	conns []*poolTestConn
+}
+
+func (c *poolTestCluster) DialHost(id string) (cluster.Host, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	conn := &poolTestConn{Host: newFakeHostClient()}
+	c.conns = append(c.conns, conn)
+	return conn, nil
+}
+
+type poolTestConn struct {
+	cluster.Host
+	err    error
+	closed bool
+}
+
+func (c *poolTestConn) GetJob(id string) (*host.ActiveJob, error) {
+	return nil, c.err
+}
+
+func (c *poolTestConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (s *S) TestHostPool(c *C) {
+	cc := &poolTestCluster{}
+	clk := newFakeClock()
+	pool := newHostPool(cc, time.Hour, clk)
+	defer pool.Close()
+
+	// a closed handle is reused
+	h0, err := pool.DialHost("host0")
+	c.Assert(err, IsNil)
+	c.Assert(h0.Close(), IsNil)
+	c.Assert(h0.Close(), IsNil)
+	h1, err := pool.DialHost("host0")
+	c.Assert(err, IsNil)
+	c.Assert(h1.(*pooledHost).Host, Equals, cc.conns[0])
+	c.Assert(cc.conns, HasLen, 1)
+
+	// handles that are in use are not shared
+	h2, err := pool.DialHost("host0")
+	c.Assert(err, IsNil)
+	c.Assert(h2.(*pooledHost).Host, Equals, cc.conns[1])
+	h3, err := pool.DialHost("host1")
+	c.Assert(err, IsNil)
+	c.Assert(h3.(*pooledHost).Host, Equals, cc.conns[2])
+
+	// a connection that has failed is closed instead of being reused
+	cc.conns[0].err = io.EOF
+	_, err = h1.GetJob("job0")
+	c.Assert(err, Equals, io.EOF)
+	h1.Close()
+	c.Assert(cc.conns[0].closed, Equals, true)
+	h2.Close()
+	h3.Close()
+	c.Assert(cc.conns[1].closed, Equals, false)
+	h, _ := pool.DialHost("host0")
+	c.Assert(h.(*pooledHost).Host, Equals, cc.conns[1])
+	h.Close()
+
+	// only a few idle connections are kept for each host
+	handles := make([]cluster.Host, maxIdleHostConns+1)
+	for i := range handles {
+		handles[i], _ = pool.DialHost("host2")
+	}
+	for _, h := range handles {
+		h.Close()
+	}
+	closed := 0
+	for _, conn := range cc.conns {
+		if conn.closed {
+			closed++
+		}
+	}
+	c.Assert(closed, Equals, 2)
+
+	// idle connections are closed once they expire
+	for i := 0; i < 100 && clk.Waiting() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	clk.Advance(time.Hour)
+	for i := 0; i < 100 && clk.Waiting() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	clk.Advance(time.Hour)
+	for i := 0; i < 100 && clk.Waiting() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, conn := range cc.conns {
+		c.Assert(conn.closed, Equals, true)
+	}
+	h, _ = pool.DialHost("host1")
+	c.Assert(h.(*pooledHost).Host, Equals, cc.conns[len(cc.conns)-1])
+	c.Assert(cc.conns[len(cc.conns)-1].closed, Equals, false)
+	h.Close()
+}
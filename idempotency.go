@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultIdempotencyTTL is how long the result of a request with an
+// Idempotency-Key header is remembered.
+const defaultIdempotencyTTL = 5 * time.Minute
+
+// idempotencyCache remembers the responses to requests that carry an
+// idempotency key, so that retried requests are not acted on twice.
+type idempotencyCache struct {
+	ttl   time.Duration
+	clock clock
+
+	mtx     sync.Mutex
+	entries map[string]*idempotentResult
+}
+
+type idempotentResult struct {
+	// done is closed once the first request with the key has finished
+	done    chan struct{}
+	res     interface{}
+	expires time.Time
+}
+
+func newIdempotencyCache(ttl time.Duration, clk clock) *idempotencyCache {
+	return &idempotencyCache{ttl: ttl, clock: clk, entries: make(map[string]*idempotentResult)}
+}
+
+// begin returns the cached response for key, waiting for a request with the
+// same key that is in flight. If there is no response to reuse the key is
+// reserved, false is returned, and the caller must call finish.
+func (c *idempotencyCache) begin(key string) (interface{}, bool) {
+	for {
+		c.mtx.Lock()
+		e, ok := c.entries[key]
+		if ok && e.res != nil && c.clock.Now().After(e.expires) {
+			delete(c.entries, key)
+			ok = false
+		}
+		if !ok {
+			c.entries[key] = &idempotentResult{done: make(chan struct{})}
+			c.mtx.Unlock()
+			return nil, false
+		}
+		c.mtx.Unlock()
+
+		<-e.done
+		if e.res != nil {
+			return e.res, true
+		}
+		// the other request failed, so this one may try again
+	}
+}
+
+// finish records the response for a key reserved by begin. A nil res means
+// that the request failed and the key is released without caching anything.
+func (c *idempotencyCache) finish(key string, res interface{}) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	now := c.clock.Now()
+	for k, e := range c.entries {
+		if e.res != nil && now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	if res == nil {
+		delete(c.entries, key)
+	} else {
+		e.res = res
+		e.expires = now.Add(c.ttl)
+	}
+	close(e.done)
+}
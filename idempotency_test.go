@@ -0,0 +1,34 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) TestIdempotencyCache(c *C) {
+	clk := newFakeClock()
+	cache := newIdempotencyCache(time.Minute, clk)
+
+	_, ok := cache.begin("a")
+	c.Assert(ok, Equals, false)
+	waiting := make(chan interface{})
+	go func() {
+		res, _ := cache.begin("a")
+		waiting <- res
+	}()
+	cache.finish("a", "first")
+	c.Assert(<-waiting, Equals, "first")
+
+	// a failed request releases the key
+	_, ok = cache.begin("b")
+	c.Assert(ok, Equals, false)
+	cache.finish("b", nil)
+	_, ok = cache.begin("b")
+	c.Assert(ok, Equals, false)
+	cache.finish("b", "second")
+
+	clk.Advance(time.Minute + time.Second)
+	_, ok = cache.begin("a")
+	c.Assert(ok, Equals, false)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-host/types"
+	"github.com/flynn/go-flynn/cluster"
+	"github.com/technoweenie/grohl"
+)
+
+const (
+	// defaultJobHistorySize is how many exited one-off jobs are remembered.
+	defaultJobHistorySize = 1000
+	// defaultJobHistoryTTL is how long an exited one-off job is remembered.
+	defaultJobHistoryTTL = 15 * time.Minute
+)
+
+// jobHistoryPoll is how often exitWatcher checks on the jobs that it watches
+// in case the host does not report that they have stopped.
+var jobHistoryPoll = 5 * time.Second
+
+// jobHistoryStartTimeout is how long exitWatcher waits for a job that has
+// just been scheduled to turn up on its host.
+var jobHistoryStartTimeout = time.Minute
+
+// jobHistory remembers one-off jobs that have exited, so that their outcome
+// can still be looked up once their host has forgotten them. It is a ring of
+// a fixed size, so the oldest jobs are dropped first.
+type jobHistory struct {
+	ttl   time.Duration
+	clock clock
+
+	mtx  sync.Mutex
+	jobs []finishedJob
+	next int
+}
+
+type finishedJob struct {
+	appID   string
+	job     ct.Job
+	expires time.Time
+}
+
+func newJobHistory(size int, ttl time.Duration, clk clock) *jobHistory {
+	if size <= 0 {
+		size = defaultJobHistorySize
+	}
+	if ttl <= 0 {
+		ttl = defaultJobHistoryTTL
+	}
+	return &jobHistory{ttl: ttl, clock: clk, jobs: make([]finishedJob, size)}
+}
+
+func (h *jobHistory) add(appID string, job ct.Job) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.jobs[h.next] = finishedJob{appID: appID, job: job, expires: h.clock.Now().Add(h.ttl)}
+	h.next = (h.next + 1) % len(h.jobs)
+}
+
+// get returns the app's exited job with the given composite ID.
+func (h *jobHistory) get(appID, id string) (ct.Job, bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	now := h.clock.Now()
+	for _, j := range h.jobs {
+		if j.job.ID == id && j.appID == appID && now.Before(j.expires) {
+			return j.job, true
+		}
+	}
+	return ct.Job{}, false
+}
+
+// exitWatcher adds one-off jobs to history once they exit. It follows a
+// single event stream for each host that has jobs being watched, for as long
+// as there are any, and stops when the controller shuts down.
+type exitWatcher struct {
+	cl       clusterClient
+	clock    clock
+	sessions *sessionRegistry
+	l        *grohl.Context
+
+	mtx   sync.Mutex
+	hosts map[string]*hostExits
+}
+
+// hostExits is the set of jobs that are being watched on a host.
+type hostExits struct {
+	id   string
+	jobs map[string]*watchedJob
+}
+
+type watchedJob struct {
+	appID   string
+	history *jobHistory
+	added   time.Time
+	seen    bool
+}
+
+func newExitWatcher(cl clusterClient, clk clock, sessions *sessionRegistry, l *grohl.Context) *exitWatcher {
+	return &exitWatcher{cl: cl, clock: clk, sessions: sessions, l: l, hosts: make(map[string]*hostExits)}
+}
+
+// watch adds the job to history once it exits. Jobs that are removed from
+// the host before they are seen to exit are not recorded.
+func (w *exitWatcher) watch(history *jobHistory, appID, hostID, jobID string) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	h, ok := w.hosts[hostID]
+	if !ok {
+		h = &hostExits{id: hostID, jobs: make(map[string]*watchedJob)}
+		w.hosts[hostID] = h
+		go w.watchHost(h)
+	}
+	h.jobs[jobID] = &watchedJob{appID: appID, history: history, added: w.clock.Now()}
+}
+
+// watchHost checks on the host's watched jobs each time one of its jobs stops,
+// and every jobHistoryPoll in case the host doesn't report it.
+func (w *exitWatcher) watchHost(h *hostExits) {
+	stop := make(chan struct{})
+	defer w.sessions.add(func() { close(stop) })()
+	defer w.forget(h)
+	l := w.l.New(grohl.Data{"op": "job_history", "host_id": h.id})
+
+	client, err := w.cl.DialHost(h.id)
+	if err != nil {
+		l.Log(grohl.Data{"at": "connect_host", "error": err})
+		return
+	}
+	defer client.Close()
+
+	events := make(chan *host.Event)
+	if stream := client.StreamEvents("all", events); stream != nil {
+		defer stream.Close()
+	}
+	poll := w.clock.After(jobHistoryPoll)
+	for {
+		var ids []string
+		select {
+		case e, ok := <-events:
+			if !ok {
+				// the event stream failed, rely on polling alone
+				events = nil
+				continue
+			}
+			if e.Event != "stop" && e.Event != "error" {
+				continue
+			}
+			ids = []string{e.JobID}
+		case <-poll:
+			poll = w.clock.After(jobHistoryPoll)
+			ids = w.jobIDs(h)
+		case <-stop:
+			return
+		}
+		for _, id := range ids {
+			if err := w.check(l, client, h, id); err != nil {
+				return
+			}
+		}
+		if w.idle(h) {
+			return
+		}
+	}
+}
+
+// check adds a watched job to history if it has exited. It only returns an
+// error if the host connection is broken.
+func (w *exitWatcher) check(l *grohl.Context, client cluster.Host, h *hostExits, jobID string) error {
+	w.mtx.Lock()
+	j, ok := h.jobs[jobID]
+	w.mtx.Unlock()
+	if !ok {
+		return nil
+	}
+	active, err := client.GetJob(jobID)
+	if err != nil {
+		if hostConnError(err) {
+			l.Log(grohl.Data{"at": "get_job", "job_id": jobID, "error": err})
+			return err
+		}
+		return nil
+	}
+	if active == nil || active.Job == nil {
+		if j.seen || w.clock.Now().Sub(j.added) > jobHistoryStartTimeout {
+			w.remove(h, jobID)
+		}
+		return nil
+	}
+	j.seen = true
+	if job := activeJob(h.id, active); job.ExitCode != nil {
+		l.Log(grohl.Data{"at": "exited", "job_id": jobID, "exit_code": *job.ExitCode})
+		j.history.add(j.appID, job)
+		w.remove(h, jobID)
+	}
+	return nil
+}
+
+func (w *exitWatcher) jobIDs(h *hostExits) []string {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	ids := make([]string, 0, len(h.jobs))
+	for id := range h.jobs {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (w *exitWatcher) remove(h *hostExits, jobID string) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	delete(h.jobs, jobID)
+}
+
+// idle stops watching the host if none of its jobs are left, so that the
+// next job that is watched on it starts a new stream.
+func (w *exitWatcher) idle(h *hostExits) bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if len(h.jobs) > 0 {
+		return false
+	}
+	if w.hosts[h.id] == h {
+		delete(w.hosts, h.id)
+	}
+	return true
+}
+
+// forget drops the host's jobs once its stream has ended.
+func (w *exitWatcher) forget(h *hostExits) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.hosts[h.id] == h {
+		delete(w.hosts, h.id)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-controller/utils"
+	"github.com/flynn/flynn-host/types"
+	"github.com/flynn/go-flynn/cluster"
+	"github.com/technoweenie/grohl"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) TestJobHistoryBounds(c *C) {
+	clk := newFakeClock()
+	history := newJobHistory(2, time.Minute, clk)
+	for _, id := range []string{"job0", "job1", "job2"} {
+		history.add("app0", ct.Job{ID: id})
+	}
+
+	// the oldest job makes way once the history is full
+	_, ok := history.get("app0", "job0")
+	c.Assert(ok, Equals, false)
+	job, ok := history.get("app0", "job2")
+	c.Assert(ok, Equals, true)
+	c.Assert(job.ID, Equals, "job2")
+	_, ok = history.get("app1", "job2")
+	c.Assert(ok, Equals, false)
+
+	clk.Advance(time.Minute + time.Second)
+	_, ok = history.get("app0", "job2")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *S) TestGetJobHistory(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "get-job-history"})
+	other := s.createTestApp(c, &ct.App{Name: "get-job-history-other"})
+	defer func(d time.Duration) { jobHistoryPoll = d }(jobHistoryPoll)
+	jobHistoryPoll = 10 * time.Millisecond
+	history := newJobHistory(10, time.Minute, realClock{})
+	s.m.Map(history)
+	defer s.m.Map(newJobHistory(0, 0, realClock{}))
+
+	hostID := utils.UUID()
+	hc := newFakeHostClient()
+	s.cc.setHostClient(hostID, hc)
+	s.cc.setHosts(map[string]host.Host{hostID: {ID: hostID}})
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://foo/bar"})
+	release := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+
+	endedAt := time.Now().UTC().Truncate(time.Second)
+	exited := make(chan struct{})
+	hc.getJobFunc = func(id string) *host.ActiveJob {
+		select {
+		case <-exited:
+			// the host has removed the job
+			return nil
+		default:
+		}
+		return &host.ActiveJob{
+			Job:      &host.Job{ID: id, Attributes: map[string]string{"flynn-controller.app": app.ID}},
+			Status:   host.StatusCrashed,
+			ExitCode: 3,
+			EndedAt:  endedAt,
+		}
+	}
+
+	job := &ct.Job{}
+	_, err := s.Post("/apps/"+app.ID+"/jobs", &ct.NewJob{ReleaseID: release.ID, Cmd: []string{"false"}}, job)
+	c.Assert(err, IsNil)
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := history.get(app.ID, job.ID); ok {
+			break
+		}
+		if time.Since(start) > time.Second {
+			c.Fatal("the job was not recorded")
+		}
+	}
+	close(exited)
+
+	actual := &ct.Job{}
+	_, err = s.Get("/apps/"+app.ID+"/jobs/"+job.ID, actual)
+	c.Assert(err, IsNil)
+	c.Assert(actual.State, Equals, ct.JobStateCrashed)
+	c.Assert(actual.ExitCode, NotNil)
+	c.Assert(*actual.ExitCode, Equals, 3)
+	c.Assert(actual.EndedAt.Equal(endedAt), Equals, true)
+
+	res, _ := s.Get("/apps/"+other.ID+"/jobs/"+job.ID, actual)
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+// streamHostClient is a host client that hands out the event streams that
+// are opened on it.
+type streamHostClient struct {
+	*fakeHostClient
+	mtx     sync.Mutex
+	streams []chan<- *host.Event
+	closed  int
+}
+
+func (c *streamHostClient) StreamEvents(id string, ch chan<- *host.Event) cluster.Stream {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.streams = append(c.streams, ch)
+	return streamCloser{c}
+}
+
+func (c *streamHostClient) counts() (streams, closed int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.streams), c.closed
+}
+
+type streamCloser struct{ c *streamHostClient }
+
+func (s streamCloser) Close() error {
+	s.c.mtx.Lock()
+	defer s.c.mtx.Unlock()
+	s.c.closed++
+	return nil
+}
+
+func (s streamCloser) Err() error { return nil }
+
+func (S) TestExitWatcher(c *C) {
+	clk := newFakeClock()
+	cc := newFakeCluster()
+	hc := &streamHostClient{fakeHostClient: newFakeHostClient()}
+	var mtx sync.Mutex
+	exited := make(map[string]bool)
+	hc.getJobFunc = func(id string) *host.ActiveJob {
+		mtx.Lock()
+		defer mtx.Unlock()
+		job := &host.ActiveJob{Job: &host.Job{ID: id}, Status: host.StatusRunning}
+		if exited[id] {
+			job.Status = host.StatusDone
+		}
+		return job
+	}
+	exit := func(id string) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		exited[id] = true
+	}
+	cc.setHostClient("host0", hc)
+	sessions := newSessionRegistry(clk)
+	history := newJobHistory(10, time.Minute, clk)
+	w := newExitWatcher(cc, clk, sessions, grohl.NewContext(nil))
+	recorded := func(id string) bool {
+		for i := 0; i < 100; i++ {
+			if _, ok := history.get("app0", "host0-"+id); ok {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	// all of a host's jobs share one event stream
+	for _, id := range []string{"job0", "job1", "job2"} {
+		w.watch(history, "app0", "host0", id)
+	}
+	for i := 0; i < 100 && clk.Waiting() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	streams, _ := hc.counts()
+	c.Assert(streams, Equals, 1)
+
+	exit("job0")
+	hc.streams[0] <- &host.Event{Event: "stop", JobID: "job0"}
+	c.Assert(recorded("job0"), Equals, true)
+
+	// jobs that exit without an event are found when the host is polled
+	exit("job1")
+	clk.Advance(jobHistoryPoll)
+	c.Assert(recorded("job1"), Equals, true)
+	_, ok := history.get("app0", "host0-job2")
+	c.Assert(ok, Equals, false)
+
+	// the stream is closed when the controller shuts down
+	c.Assert(sessions.shutdown(time.Second), Equals, true)
+	streams, closed := hc.counts()
+	c.Assert(streams, Equals, 1)
+	c.Assert(closed, Equals, 1)
+}
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	ct "github.com/flynn/flynn-controller/types"
 	"github.com/flynn/flynn-controller/utils"
@@ -17,6 +26,7 @@ import (
 	"github.com/flynn/go-flynn/cluster"
 	"github.com/flynn/go-flynn/demultiplex"
 	"github.com/go-martini/martini"
+	"github.com/technoweenie/grohl"
 )
 
 type clusterClient interface {
@@ -25,259 +35,2949 @@ type clusterClient interface {
 	AddJobs(*host.AddJobsReq) (*host.AddJobsRes, error)
 }
 
-func jobList(app *ct.App, cc clusterClient, r ResponseHelper) {
+const defaultJobListLimit = 100
+
+func jobList(app *ct.App, cc clusterClient, req *http.Request, w http.ResponseWriter, l *grohl.Context, r ResponseHelper) {
+	limit, err := parseIntParam(req, "limit", defaultJobListLimit)
+	if err == nil && limit <= 0 {
+		err = ct.ValidationError{Field: "limit", Message: "must be positive"}
+	}
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	offset, err := parseIntParam(req, "offset", 0)
+	if err == nil && offset < 0 {
+		err = ct.ValidationError{Field: "offset", Message: "must not be negative"}
+	}
+	if err != nil {
+		r.Error(err)
+		return
+	}
+
+	sortBy := req.FormValue("sort")
+	if sortBy != "" && sortBy != "created_at" {
+		r.Error(ct.ValidationError{Field: "sort", Message: "is invalid"})
+		return
+	}
+	filter, err := newJobFilter(req)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+
 	hosts, err := cc.ListHosts()
 	if err != nil {
 		r.Error(err)
 		return
 	}
-	var jobs []ct.Job
+	var jobs sortJobs
+	// the same job may be reported more than once while it is being moved,
+	// so only the first occurrence of each composite ID is kept
+	seen := make(map[string]struct{})
 	for _, h := range hosts {
 		for _, j := range h.Jobs {
 			if j.Attributes["flynn-controller.app"] != app.ID {
 				continue
 			}
 
-			job := ct.Job{
-				ID:        h.ID + "-" + j.ID,
-				Type:      j.Attributes["flynn-controller.type"],
-				ReleaseID: j.Attributes["flynn-controller.release"],
+			job := jobFromHost(h.ID, j)
+			if _, ok := seen[job.ID]; ok {
+				continue
 			}
+			seen[job.ID] = struct{}{}
+			job.State = jobState(j)
 			if job.Type == "" {
 				job.Cmd = j.Config.Cmd
 			}
-			jobs = append(jobs, job)
+			if !filter.match(&job) {
+				continue
+			}
+			jobs = append(jobs, sortJob{hostID: h.ID, jobID: j.ID, job: job})
 		}
 	}
+	if sortBy == "created_at" {
+		sort.Sort(sortJobsByCreatedAt{jobs})
+	} else {
+		sort.Sort(jobs)
+	}
 
-	r.JSON(200, jobs)
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(jobs)))
+	if strings.Contains(req.Header.Get("Accept"), "text/csv") {
+		if req.FormValue("limit") == "" {
+			// exports are of every job unless a page is asked for
+			limit = len(jobs)
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.WriteHeader(200)
+		if err := writeJobsCSV(w, jobs.page(limit, offset)); err != nil {
+			l.Log(grohl.Data{"at": "write_csv", "app_id": app.ID, "error": err})
+		}
+		return
+	}
+	r.JSON(200, jobs.page(limit, offset))
 }
 
-func jobLog(req *http.Request, app *ct.App, params martini.Params, cluster cluster.Host, w http.ResponseWriter, r ResponseHelper) {
-	attachReq := &host.AttachReq{
-		JobID: params["jobs_id"],
-		Flags: host.AttachFlagStdout | host.AttachFlagStderr | host.AttachFlagLogs,
-	}
-	if tail := req.FormValue("tail"); tail != "" {
-		attachReq.Flags |= host.AttachFlagStream
+// jobCSVHeader names the columns of jobList's text/csv response.
+var jobCSVHeader = []string{"host_id", "job_id", "type", "release", "state", "created_at"}
+
+func writeJobsCSV(w io.Writer, jobs []ct.Job) error {
+	cw := csv.NewWriter(w)
+	cw.Write(jobCSVHeader)
+	for _, j := range jobs {
+		var created string
+		if j.CreatedAt != nil {
+			created = j.CreatedAt.UTC().Format(time.RFC3339)
+		}
+		cw.Write([]string{j.HostID, j.JobID, j.Type, j.ReleaseID, j.State, created})
 	}
-	stream, _, err := cluster.Attach(attachReq, false)
+	cw.Flush()
+	return cw.Error()
+}
+
+// jobCount returns the number of the app's jobs of each type that have not
+// stopped, one-off jobs are counted under the empty type.
+func jobCount(app *ct.App, cc clusterClient, r ResponseHelper) {
+	hosts, err := cc.ListHosts()
 	if err != nil {
-		// TODO: handle AttachWouldWait
 		r.Error(err)
 		return
 	}
-	defer stream.Close()
-	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
-		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
-		ssew := NewSSELogWriter(w)
-		demultiplex.Copy(ssew.Stream("stdout"), ssew.Stream("stderr"), stream)
-		// TODO: include exit code here if tailing
-		w.Write([]byte("event: eof\ndata: {}\n\n"))
-	} else {
-		io.Copy(w, stream)
+	counts := make(map[string]int)
+	seen := make(map[string]struct{})
+	for _, h := range hosts {
+		for _, j := range h.Jobs {
+			if j.Attributes["flynn-controller.app"] != app.ID {
+				continue
+			}
+			id := utils.FormatJobID(h.ID, j.ID)
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen[id] = struct{}{}
+			if s := jobState(j); s == ct.JobStateDown || s == ct.JobStateCrashed {
+				continue
+			}
+			counts[j.Attributes["flynn-controller.type"]]++
+		}
 	}
+	r.JSON(200, counts)
 }
 
-type SSELogWriter interface {
-	Stream(string) io.Writer
+// hostJobs lists all of the jobs on a host, whichever app they belong to.
+func hostJobs(params martini.Params, cc clusterClient, r ResponseHelper) {
+	hosts, err := cc.ListHosts()
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	h, ok := hosts[params["hosts_id"]]
+	if !ok {
+		r.Error(ErrNotFound)
+		return
+	}
+	jobs := make(sortJobs, 0, len(h.Jobs))
+	for _, j := range h.Jobs {
+		jobs = append(jobs, sortJob{hostID: h.ID, jobID: j.ID, job: clusterJob(h.ID, j)})
+	}
+	sort.Sort(jobs)
+	r.JSON(200, jobs.page(len(jobs), 0))
 }
 
-func NewSSELogWriter(w io.Writer) SSELogWriter {
-	return &sseLogWriter{Writer: w, Encoder: json.NewEncoder(w)}
+const jobAttrParamPrefix = "attr."
+
+// searchJobs lists the jobs of every app that have all of the attributes
+// given as attr.<key>=<value> query parameters. An attribute that is given
+// more than once matches any of its values.
+func searchJobs(req *http.Request, cc clusterClient, r ResponseHelper) {
+	attrs := make(map[string][]string)
+	for k, v := range req.URL.Query() {
+		if !strings.HasPrefix(k, jobAttrParamPrefix) {
+			continue
+		}
+		key := strings.TrimPrefix(k, jobAttrParamPrefix)
+		if key == "" {
+			r.Error(ct.ValidationError{Field: k, Message: "must name an attribute"})
+			return
+		}
+		attrs[key] = v
+	}
+	if len(attrs) == 0 {
+		r.Error(ct.ValidationError{Field: "attr", Message: "at least one attribute is required"})
+		return
+	}
+
+	hosts, err := cc.ListHosts()
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	var jobs sortJobs
+	for _, h := range hosts {
+		for _, j := range h.Jobs {
+			if matchJobAttrs(j.Attributes, attrs) {
+				jobs = append(jobs, sortJob{hostID: h.ID, jobID: j.ID, job: clusterJob(h.ID, j)})
+			}
+		}
+	}
+	sort.Sort(jobs)
+	r.JSON(200, jobs.page(len(jobs), 0))
 }
 
-type sseLogWriter struct {
-	io.Writer
-	*json.Encoder
-	sync.Mutex
+// matchJobAttrs reports whether attrs has each of the wanted attributes with
+// one of its values.
+func matchJobAttrs(attrs map[string]string, want map[string][]string) bool {
+	for k, values := range want {
+		v, ok := attrs[k]
+		if !ok {
+			return false
+		}
+		matched := false
+		for _, w := range values {
+			if v == w {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
 }
 
-func (w *sseLogWriter) Stream(s string) io.Writer {
-	return &sseLogStreamWriter{w: w, s: s}
+// clusterJob is the view of a job that is listed outside of its app, so it
+// includes the app ID.
+func clusterJob(hostID string, j *host.Job) ct.Job {
+	job := jobFromHost(hostID, j)
+	job.App = j.Attributes["flynn-controller.app"]
+	job.State = jobState(j)
+	if job.Type == "" && j.Config != nil {
+		job.Cmd = j.Config.Cmd
+	}
+	return job
 }
 
-type sseLogStreamWriter struct {
-	w *sseLogWriter
-	s string
+func jobFromHost(hostID string, j *host.Job) ct.Job {
+	job := ct.Job{
+		ID:        utils.FormatJobID(hostID, j.ID),
+		HostID:    hostID,
+		JobID:     j.ID,
+		Type:      j.Attributes["flynn-controller.type"],
+		ReleaseID: j.Attributes["flynn-controller.release"],
+	}
+	for k, v := range j.Attributes {
+		if strings.HasPrefix(k, jobMetaPrefix) {
+			if job.Meta == nil {
+				job.Meta = make(map[string]string)
+			}
+			job.Meta[strings.TrimPrefix(k, jobMetaPrefix)] = v
+		}
+	}
+	job.Memory = parseLimitAttr(j.Attributes["flynn-controller.memory"])
+	job.CPUShares = parseLimitAttr(j.Attributes["flynn-controller.cpu_shares"])
+	job.User = j.Attributes["flynn-controller.user"]
+	if t, err := time.Parse(time.RFC3339, j.Attributes["flynn-controller.created_at"]); err == nil {
+		job.CreatedAt = &t
+	}
+	return job
 }
 
-type sseLogChunk struct {
-	Stream string `json:"stream"`
-	Data   string `json:"data"`
+// parseLimitAttr parses a resource limit stored in a job attribute, missing or
+// malformed values are treated as no limit.
+func parseLimitAttr(s string) int64 {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
 }
 
-func (w *sseLogStreamWriter) Write(p []byte) (int, error) {
-	w.w.Lock()
-	defer w.w.Unlock()
+// Job kinds that jobList can be filtered by, service jobs are the ones with a
+// process type.
+const (
+	jobKindOneOff  = "oneoff"
+	jobKindService = "service"
+)
 
-	if _, err := w.w.Write([]byte("data: ")); err != nil {
-		return 0, err
+type jobFilter struct {
+	typ, release, kind string
+}
+
+func newJobFilter(req *http.Request) (*jobFilter, error) {
+	f := &jobFilter{
+		typ:     req.FormValue("type"),
+		release: req.FormValue("release"),
+		kind:    req.FormValue("kind"),
 	}
-	if err := w.w.Encode(&sseLogChunk{Stream: w.s, Data: string(p)}); err != nil {
-		return 0, err
+	switch f.kind {
+	case "", jobKindOneOff, jobKindService:
+	default:
+		return nil, ct.ValidationError{Field: "kind", Message: "must be oneoff or service"}
 	}
-	_, err := w.w.Write([]byte("\n"))
-	return len(p), err
+	return f, nil
 }
 
-func parseJobID(params martini.Params) (string, string) {
-	id := strings.SplitN(params["jobs_id"], "-", 2)
-	if len(id) != 2 || id[0] == "" || id[1] == "" {
-		return "", ""
+func (f *jobFilter) match(job *ct.Job) bool {
+	if f.typ != "" && job.Type != f.typ {
+		return false
+	}
+	if f.kind == jobKindOneOff && job.Type != "" || f.kind == jobKindService && job.Type == "" {
+		return false
 	}
-	return id[0], id[1]
+	if f.release != "" && job.ReleaseID != f.release {
+		return false
+	}
+	return true
 }
 
-func connectHostMiddleware(c martini.Context, params martini.Params, cl clusterClient, r ResponseHelper) {
-	hostID, jobID := parseJobID(params)
-	if hostID == "" {
-		log.Printf("Unable to parse hostID from %q", params["jobs_id"])
-		r.Error(ErrNotFound)
-		return
+// jobState returns the state that the host reported in the job attributes.
+func jobState(j *host.Job) string {
+	switch s := j.Attributes["flynn-host.state"]; s {
+	case ct.JobStateStarting, ct.JobStateUp, ct.JobStateDown, ct.JobStateCrashed:
+		return s
 	}
-	params["jobs_id"] = jobID
+	return ct.JobStateUnknown
+}
 
-	client, err := cl.DialHost(hostID)
-	if err != nil {
-		r.Error(err)
-		return
+func activeJobState(j *host.ActiveJob) string {
+	switch j.Status {
+	case host.StatusStarting:
+		return ct.JobStateStarting
+	case host.StatusRunning:
+		return ct.JobStateUp
+	case host.StatusDone:
+		return ct.JobStateDown
+	case host.StatusCrashed, host.StatusFailed:
+		return ct.JobStateCrashed
 	}
-	c.MapTo(client, (*cluster.Host)(nil))
+	return ct.JobStateUnknown
+}
 
-	c.Next()
-	client.Close()
+// activeJob is the view of a job that getJob returns.
+func activeJob(hostID string, active *host.ActiveJob) ct.Job {
+	job := jobFromHost(hostID, active.Job)
+	job.State = activeJobState(active)
+	if config := active.Job.Config; config != nil {
+		job.Cmd = config.Cmd
+		job.Env = utils.ParseEnv(config.Env)
+	}
+	if job.State == ct.JobStateDown || job.State == ct.JobStateCrashed {
+		exitCode := active.ExitCode
+		job.ExitCode = &exitCode
+		if !active.EndedAt.IsZero() {
+			endedAt := active.EndedAt
+			job.EndedAt = &endedAt
+		}
+	}
+	return job
 }
 
-func killJob(app *ct.App, params martini.Params, client cluster.Host, r ResponseHelper) {
-	if err := client.StopJob(params["jobs_id"]); err != nil {
+// getJob returns a job from its host, or from history if it is a one-off job
+// that has exited and been removed from the host.
+func getJob(app *ct.App, params martini.Params, client cluster.Host, history *jobHistory, r ResponseHelper) {
+	active, err := client.GetJob(params["jobs_id"])
+	if err != nil {
 		r.Error(err)
 		return
 	}
+	if active == nil || active.Job == nil {
+		if job, ok := history.get(app.ID, utils.FormatJobID(params["hosts_id"], params["jobs_id"])); ok {
+			r.JSON(200, &job)
+			return
+		}
+		r.Error(ErrNotFound)
+		return
+	}
+	if active.Job.Attributes["flynn-controller.app"] != app.ID {
+		r.Error(ErrNotFound)
+		return
+	}
+
+	job := activeJob(params["hosts_id"], active)
+	r.JSON(200, &job)
 }
 
-func runJob(app *ct.App, newJob ct.NewJob, releases *ReleaseRepo, artifacts *ArtifactRepo, cl clusterClient, req *http.Request, w http.ResponseWriter, r ResponseHelper) {
-	data, err := releases.Get(newJob.ReleaseID)
+// getJobRelease returns the release that a job was run from and its artifact.
+func getJobRelease(app *ct.App, params martini.Params, client cluster.Host, releases *ReleaseRepo, artifacts *ArtifactRepo, r ResponseHelper) {
+	active, err := client.GetJob(params["jobs_id"])
 	if err != nil {
 		r.Error(err)
 		return
 	}
-	release := data.(*ct.Release)
-	data, err = artifacts.Get(release.ArtifactID)
+	if active == nil || active.Job == nil || active.Job.Attributes["flynn-controller.app"] != app.ID {
+		r.Error(ErrNotFound)
+		return
+	}
+	releaseID := active.Job.Attributes["flynn-controller.release"]
+	if releaseID == "" {
+		r.Error(ErrNotFound)
+		return
+	}
+
+	data, err := releases.Get(releaseID)
 	if err != nil {
 		r.Error(err)
 		return
 	}
-	artifact := data.(*ct.Artifact)
-	image, err := utils.DockerImage(artifact.URI)
+	res := &ct.JobRelease{Release: data.(*ct.Release)}
+	if res.Release.ArtifactID != "" {
+		data, err := artifacts.Get(res.Release.ArtifactID)
+		if err != nil {
+			r.Error(err)
+			return
+		}
+		res.Artifact = data.(*ct.Artifact)
+	}
+	r.JSON(200, res)
+}
+
+func parseIntParam(req *http.Request, name string, def int) (int, error) {
+	s := req.FormValue(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
 	if err != nil {
-		log.Println("error parsing artifact uri", err)
-		r.Error(ct.ValidationError{
-			Field:   "artifact.uri",
-			Message: "is invalid",
-		})
-		return
+		return 0, ct.ValidationError{Field: name, Message: "must be an integer"}
 	}
-	attach := strings.Contains(req.Header.Get("Accept"), "application/vnd.flynn.attach")
+	return n, nil
+}
 
-	job := &host.Job{
-		ID: cluster.RandomJobID(""),
-		Attributes: map[string]string{
-			"flynn-controller.app":     app.ID,
-			"flynn-controller.release": release.ID,
-		},
-		Config: &docker.Config{
-			Cmd:          newJob.Cmd,
-			Env:          utils.FormatEnv(release.Env, newJob.Env),
-			Image:        image,
-			AttachStdout: true,
-			AttachStderr: true,
-		},
+type sortJob struct {
+	hostID, jobID string
+	job           ct.Job
+}
+
+type sortJobs []sortJob
+
+func (s sortJobs) Len() int { return len(s) }
+func (s sortJobs) Less(i, j int) bool {
+	if s[i].hostID == s[j].hostID {
+		return s[i].jobID < s[j].jobID
 	}
-	if newJob.TTY {
-		job.Config.Tty = true
+	return s[i].hostID < s[j].hostID
+}
+func (s sortJobs) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// sortJobsByCreatedAt sorts jobs from oldest to newest. Jobs without a
+// creation time predate it being recorded, so they come first.
+type sortJobsByCreatedAt struct {
+	sortJobs
+}
+
+func (s sortJobsByCreatedAt) Less(i, j int) bool {
+	a, b := s.sortJobs[i].job.CreatedAt, s.sortJobs[j].job.CreatedAt
+	switch {
+	case a == nil && b == nil, a != nil && b != nil && a.Equal(*b):
+		return s.sortJobs.Less(i, j)
+	case a == nil || b == nil:
+		return a == nil
 	}
-	if attach {
-		job.Config.AttachStdin = true
-		job.Config.StdinOnce = true
-		job.Config.OpenStdin = true
+	return a.Before(*b)
+}
+
+func (s sortJobs) page(limit, offset int) []ct.Job {
+	if offset > len(s) {
+		offset = len(s)
 	}
+	s = s[offset:]
+	if limit < len(s) {
+		s = s[:limit]
+	}
+	jobs := make([]ct.Job, len(s))
+	for i, j := range s {
+		jobs[i] = j.job
+	}
+	return jobs
+}
 
-	hosts, err := cl.ListHosts()
-	if err != nil {
-		r.Error(err)
-		return
+// attachError translates an error from attaching to a job into one that the
+// response helper maps to a useful status code. ErrWouldWait is passed
+// through so that the client is told to retry.
+func attachError(client cluster.Host, jobID string, err error) error {
+	if _, ok := err.(*HostTimeoutError); ok || err == cluster.ErrWouldWait {
+		return err
 	}
-	// pick a random host
-	var hostID string
-	for hostID = range hosts {
-		break
+	if strings.Contains(strings.ToLower(err.Error()), "not found") {
+		return ErrNotFound
 	}
-	if hostID == "" {
-		r.Error(errors.New("no hosts found"))
-		return
+	if job, jerr := client.GetJob(jobID); jerr == nil && job == nil {
+		return ErrNotFound
 	}
+	return err
+}
 
-	var attachConn cluster.ReadWriteCloser
-	var attachWait func() error
-	if attach {
-		attachReq := &host.AttachReq{
-			JobID:  job.ID,
-			Flags:  host.AttachFlagStdout | host.AttachFlagStderr | host.AttachFlagStdin | host.AttachFlagStream,
-			Height: newJob.Lines,
-			Width:  newJob.Columns,
+// stopError returns nil if stopping the job failed because it has already
+// gone, so that stopping a job can safely be retried.
+func stopError(client cluster.Host, jobID string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if strings.Contains(strings.ToLower(err.Error()), "unknown job") {
+		return nil
+	}
+	if job, jerr := client.GetJob(jobID); jerr == nil &&
+		(job == nil || job.Status == host.StatusDone || job.Status == host.StatusCrashed || job.Status == host.StatusFailed) {
+		return nil
+	}
+	return err
+}
+
+var (
+	// jobLogMediaTypes are the formats that job logs can be read in, the
+	// raw format is the framed host attach stream
+	jobLogMediaTypes = []string{"application/octet-stream", "application/x-ndjson", protoLogMediaType, "text/event-stream"}
+	runJobMediaTypes = []string{"application/json", "application/vnd.flynn.attach", "application/octet-stream", "text/event-stream"}
+)
+
+type hostConfig struct {
+	// dialTimeout and attachTimeout limit how long a host has to accept a
+	// connection and an attach request
+	dialTimeout   time.Duration
+	attachTimeout time.Duration
+	clock         clock
+}
+
+const (
+	defaultHostDialTimeout   = 10 * time.Second
+	defaultHostAttachTimeout = 30 * time.Second
+)
+
+type logConfig struct {
+	// keepAlive is the interval between SSE heartbeats on quiet log streams
+	keepAlive time.Duration
+	// bufferSize is how much output is held for a slow SSE client
+	bufferSize int
+}
+
+const defaultLogKeepAlive = 15 * time.Second
+
+type jobConfig struct {
+	// env is set in every one-off job, beneath the release and job env
+	env map[string]string
+	// maxAppJobs caps the one-off jobs an app may run at once, 0 is no cap
+	maxAppJobs int
+}
+
+// jobDeps groups the services that the job handlers share, so that a handler
+// takes them as one argument rather than one argument each.
+type jobDeps struct {
+	cluster     clusterClient
+	sched       scheduler
+	conf        *jobConfig
+	hostConf    *hostConfig
+	logConf     *logConfig
+	idempotency *idempotencyCache
+	history     *jobHistory
+	exits       *exitWatcher
+	sessions    *sessionRegistry
+	limiter     *streamLimiter
+	clock       clock
+}
+
+// jobDepsMiddleware maps the jobDeps of a request. They are gathered for each
+// request so that the services can still be mapped one at a time.
+func jobDepsMiddleware(c martini.Context, cl clusterClient, sched scheduler, conf *jobConfig, hostConf *hostConfig, logConf *logConfig, idempotency *idempotencyCache, history *jobHistory, exits *exitWatcher, sessions *sessionRegistry, limiter *streamLimiter, clk clock) {
+	c.Map(&jobDeps{
+		cluster:     cl,
+		sched:       sched,
+		conf:        conf,
+		hostConf:    hostConf,
+		logConf:     logConf,
+		idempotency: idempotency,
+		history:     history,
+		exits:       exits,
+		sessions:    sessions,
+		limiter:     limiter,
+		clock:       clk,
+	})
+}
+
+// jobLogRequest is how the client asked for a job's log.
+type jobLogRequest struct {
+	// tail is the number of lines to keep from the end, -1 keeps them all
+	tail   int
+	stream bool
+	follow bool
+	desc   bool
+
+	timestamps bool
+	merge      bool
+	sse        bool
+	ndjson     bool
+	protoLog   bool
+
+	streams logStreams
+	grep    *logGrep
+	limit   *logLimit
+	// lastEventID is where an SSE stream resumes, -1 if chunks have no IDs
+	lastEventID int64
+}
+
+// parseJobLogRequest reads the options of a jobLog request from its URL and
+// headers.
+func parseJobLogRequest(req *http.Request) (*jobLogRequest, error) {
+	opts := &jobLogRequest{
+		tail:        -1,
+		stream:      req.FormValue("stream") == "true",
+		follow:      req.FormValue("follow") == "true",
+		timestamps:  req.FormValue("timestamps") == "true",
+		merge:       req.FormValue("merge") == "true",
+		sse:         strings.Contains(req.Header.Get("Accept"), "text/event-stream"),
+		lastEventID: -1,
+	}
+	if s := req.FormValue("tail"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, ct.ValidationError{Field: "tail", Message: "must be a non-negative integer"}
 		}
-		client, err := cl.DialHost(hostID)
+		opts.tail = n
+	}
+	opts.ndjson = !opts.sse && strings.Contains(req.Header.Get("Accept"), "application/x-ndjson")
+	opts.protoLog = !opts.sse && !opts.ndjson && strings.Contains(req.Header.Get("Accept"), protoLogMediaType)
+	maxBytes, err := parseIntParam(req, "max_bytes", 0)
+	if err == nil && maxBytes < 0 {
+		err = ct.ValidationError{Field: "max_bytes", Message: "must not be negative"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if opts.streams, err = parseLogStreams(req.FormValue("streams")); err != nil {
+		return nil, err
+	}
+	if s := req.FormValue("grep"); s != "" {
+		re, err := regexp.Compile(s)
 		if err != nil {
-			r.Error(fmt.Errorf("lorne connect failed: %s", err.Error()))
-			return
+			return nil, ct.ValidationError{Field: "grep", Message: "is not a valid regular expression"}
 		}
-		defer client.Close()
-		attachConn, attachWait, err = client.Attach(attachReq, true)
-		if err != nil {
-			r.Error(fmt.Errorf("attach failed: %s", err.Error()))
-			return
+		opts.grep = &logGrep{re: re}
+	}
+	switch req.FormValue("order") {
+	case "", "asc":
+	case "desc":
+		if opts.stream || opts.follow {
+			return nil, ct.ValidationError{Field: "order", Message: "cannot be desc when streaming"}
 		}
-		defer attachConn.Close()
+		opts.desc = true
+	default:
+		return nil, ct.ValidationError{Field: "order", Message: "must be asc or desc"}
 	}
+	if opts.tail >= 0 && (opts.stream || opts.follow) {
+		// the host doesn't mark where the backlog ends and the live output
+		// starts, so the last lines of a stream can't be picked out
+		return nil, ct.ValidationError{Field: "tail", Message: "cannot be used when streaming"}
+	}
+	// chunks are given IDs so that a stream can be resumed, unless only the
+	// end of the log was requested as it may have moved on since
+	if opts.sse && opts.tail < 0 {
+		opts.lastEventID = 0
+		if s := req.Header.Get("Last-Event-ID"); s != "" {
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || id < 0 {
+				return nil, ct.ValidationError{Field: "Last-Event-ID", Message: "must be a non-negative integer"}
+			}
+			opts.lastEventID = id
+		}
+	}
+	if maxBytes > 0 {
+		opts.limit = &logLimit{max: int64(maxBytes)}
+	} else if !opts.stream && !opts.follow {
+		opts.limit = &logLimit{max: defaultJobLogMaxBytes}
+	}
+	if opts.follow {
+		if !opts.sse {
+			return nil, ct.ValidationError{Field: "follow", Message: "requires an event stream"}
+		}
+		opts.stream = true
+	}
+	return opts, nil
+}
 
-	_, err = cl.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{hostID: {job}}})
+func jobLog(req *http.Request, app *ct.App, params martini.Params, cluster cluster.Host, deps *jobDeps, l *grohl.Context, w http.ResponseWriter, r ResponseHelper) {
+	if err := checkAccept(req, jobLogMediaTypes...); err != nil {
+		r.Error(err)
+		return
+	}
+	opts, err := parseJobLogRequest(req)
 	if err != nil {
-		r.Error(fmt.Errorf("schedule failed: %s", err.Error()))
+		r.Error(err)
 		return
 	}
-
-	if attach {
-		if err := attachWait(); err != nil {
-			r.Error(fmt.Errorf("attach wait failed: %s", err.Error()))
-			return
-		}
-		w.Header().Set("Content-Type", "application/vnd.flynn.attach")
-		w.Header().Set("Content-Length", "0")
-		w.WriteHeader(http.StatusSwitchingProtocols)
-		conn, _, err := w.(http.Hijacker).Hijack()
+	s := &jobLogStream{
+		jobLogRequest: opts,
+		app:           app,
+		hostID:        params["hosts_id"],
+		jobID:         params["jobs_id"],
+		host:          cluster,
+		deps:          deps,
+		l:             l,
+	}
+	if opts.follow {
+		job, err := cluster.GetJob(s.jobID)
 		if err != nil {
-			panic(err)
+			r.Error(err)
+			return
 		}
-		defer conn.Close()
-
-		done := make(chan struct{}, 2)
-		cp := func(to cluster.ReadWriteCloser, from io.Reader) {
-			io.Copy(to, from)
-			to.CloseWrite()
-			done <- struct{}{}
+		if job == nil || job.Job == nil {
+			r.Error(ErrNotFound)
+			return
 		}
-		go cp(conn.(cluster.ReadWriteCloser), attachConn)
-		go cp(attachConn, conn)
-		<-done
-		<-done
+		s.followType = job.Job.Attributes["flynn-controller.type"]
+	}
 
+	attachReq := &host.AttachReq{
+		JobID: s.jobID,
+		Flags: host.AttachFlagStdout | host.AttachFlagStderr | host.AttachFlagLogs,
+	}
+	if opts.stream {
+		attachReq.Flags |= host.AttachFlagStream
+	}
+	if err := deps.limiter.acquire(); err != nil {
+		r.Error(err)
 		return
-	} else {
-		r.JSON(200, &ct.Job{
-			ID:        hostID + "-" + job.ID,
-			ReleaseID: newJob.ReleaseID,
-			Cmd:       newJob.Cmd,
-		})
 	}
+	defer deps.limiter.release()
+	attachStart := time.Now()
+	logs, _, err := attachHost(cluster, s.hostID, attachReq, false, deps.hostConf)
+	jobLogAttachDuration.Since(attachStart)
+	if err != nil {
+		r.Error(attachError(cluster, attachReq.JobID, err))
+		return
+	}
+	defer logs.Close()
+	openLogStreams.Inc()
+	defer openLogStreams.Dec()
+
+	// stopped is closed when the client goes away or the controller shuts
+	// down, closing the logs unblocks the copy
+	stopped := make(chan struct{})
+	var stopOnce sync.Once
+	s.stopped = stopped
+	s.stop = func() {
+		stopOnce.Do(func() {
+			close(stopped)
+			logs.Close()
+		})
+	}
+	defer deps.sessions.add(s.stop)()
+
+	// the host returns the whole log, so only keep the last lines
+	s.src = logs
+	if opts.tail >= 0 {
+		buf := newTailBuffer(opts.tail)
+		s.copy(buf.Stream(logStreamStdout), buf.Stream(logStreamStderr), nil)
+		s.src = buf.Multiplexed()
+	}
+	if opts.desc {
+		// keep the newest lines that fit within the limit, the lines that
+		// are dropped are reported as truncation
+		buf := newTailBuffer(-1)
+		buf.maxBytes = opts.limit.max
+		s.copy(
+			opts.streams.filter("stdout", opts.grep.Writer(buf.Stream(logStreamStdout))),
+			opts.streams.filter("stderr", opts.grep.Writer(buf.Stream(logStreamStderr))),
+			nil,
+		)
+		opts.grep.Flush()
+		s.src = buf.Reversed()
+		opts.limit.truncated = buf.Truncated()
+	}
+
+	if opts.sse {
+		s.serveSSE(w)
+	} else {
+		s.serveRaw(w, req)
+	}
+}
+
+// jobLogStream is a job's log on its way to the client.
+type jobLogStream struct {
+	*jobLogRequest
+	app           *ct.App
+	hostID, jobID string
+	host          cluster.Host
+	deps          *jobDeps
+	l             *grohl.Context
+	// followType is the process type whose next job is followed once the
+	// job exits, if the client asked to follow
+	followType string
+
+	// src is the multiplexed log, less what the request leaves out
+	src     io.Reader
+	stopped <-chan struct{}
+	stop    func()
+	// copyErr is the first error that broke the log stream
+	copyErr error
+}
+
+// copy demultiplexes src into stdout and stderr. stopped is nil while the log
+// is buffered, as the client isn't being written to yet.
+func (s *jobLogStream) copy(stdout, stderr io.Writer, stopped <-chan struct{}) {
+	if err := logCopyError(demultiplex.Copy(stdout, stderr, s.src), stopped); err != nil && s.copyErr == nil {
+		s.l.Log(grohl.Data{"at": "copy_log", "app_id": s.app.ID, "job_id": s.jobID, "error": err})
+		s.copyErr = err
+	}
+}
+
+// serveSSE sends the log as an event stream, ending with an eof event unless
+// the log broke off.
+func (s *jobLogStream) serveSSE(w http.ResponseWriter) {
+	conf, clk := s.deps.logConf, s.deps.clock
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	ssew := NewSSELogWriter(w, clk, s.timestamps)
+	if s.lastEventID >= 0 {
+		ssew = newResumableSSELogWriter(w, clk, s.timestamps, s.lastEventID)
+	}
+	// a slow client has output dropped instead of holding up the host
+	buf := newLogBuffer(conf.bufferSize, ssew.(*sseLogWriter).lag)
+	if s.merge {
+		ssew = mergedSSELogWriter{ssew}
+	}
+	ssew = bufferedSSELogWriter{ssew, buf}
+	stopKeepAlive, keepAliveDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		if err := ssew.KeepAlive(conf.keepAlive, stopKeepAlive); err != nil {
+			s.stop()
+		}
+		close(keepAliveDone)
+	}()
+	s.copy(
+		s.streams.filter("stdout", s.grep.Writer(s.limit.Writer(ssew.Stream("stdout")))),
+		s.streams.filter("stderr", s.grep.Writer(s.limit.Writer(ssew.Stream("stderr")))),
+		s.stopped,
+	)
+	s.grep.Flush()
+	followed := false
+	if s.followType != "" && !s.limit.Truncated() && s.copyErr == nil {
+		l := s.l.New(grohl.Data{"op": "follow_job_log", "app_id": s.app.ID})
+		followed = followJobLog(l, s.deps.cluster, clk, s.app.ID, s.followType, utils.FormatJobID(s.hostID, s.jobID), s.streams, s.grep, ssew, s.stopped)
+	}
+	close(stopKeepAlive)
+	<-keepAliveDone
+	if err := buf.Close(); err != nil {
+		// the client has gone
+		return
+	}
+	if s.copyErr != nil {
+		// the log is incomplete, so don't make it look like it ended
+		ssew.Event("error", &sseLogError{Message: s.copyErr.Error()})
+		return
+	}
+	eof := &sseLogEOF{Truncated: s.limit.Truncated()}
+	if s.stream && !followed && !eof.Truncated {
+		// the job has exited if the stream ended, so report how
+		if job, err := s.host.GetJob(s.jobID); err == nil && job != nil &&
+			(job.Status == host.StatusDone || job.Status == host.StatusCrashed || job.Status == host.StatusFailed) {
+			eof.ExitCode = &job.ExitCode
+		}
+	}
+	w.Write([]byte("event: eof\ndata: "))
+	json.NewEncoder(w).Encode(eof)
+	w.Write([]byte("\n"))
+}
+
+// serveRaw sends the log framed as the host sends it, or as NDJSON or
+// protobuf if the client asked for them.
+func (s *jobLogStream) serveRaw(w http.ResponseWriter, req *http.Request) {
+	clk := s.deps.clock
+	var out io.Writer = w
+	if !s.stream {
+		// buffered logs can be large, streams are left alone so that
+		// lines aren't held back by the compressor
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(req) {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		}
+	}
+	var stdout, stderr io.Writer
+	if s.ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		jw := newNDJSONLogWriter(out, clk, s.timestamps)
+		stdout, stderr = jw.Stream("stdout"), jw.Stream("stderr")
+		if s.merge {
+			stdout = jw.Stream(mergedLogStream)
+			stderr = stdout
+		}
+	} else if s.protoLog {
+		w.Header().Set("Content-Type", protoLogMediaType)
+		pw := newProtoLogWriter(out, clk)
+		stdout, stderr = pw.Stream("stdout"), pw.Stream("stderr")
+		if s.merge {
+			stdout = pw.Stream(mergedLogStream)
+			stderr = stdout
+		}
+	} else if s.merge {
+		// without the framing the streams are written in the order that
+		// they arrive
+		stdout = out
+		if s.timestamps {
+			stdout = &timestampWriter{w: out, clk: clk}
+		}
+		stderr = stdout
+	} else if s.timestamps {
+		stdout = &timestampWriter{w: multiplexWriter{out, logStreamStdout}, clk: clk}
+		stderr = &timestampWriter{w: multiplexWriter{out, logStreamStderr}, clk: clk}
+	} else if s.limit != nil || !s.streams.all() || s.grep != nil {
+		stdout, stderr = multiplexWriter{out, logStreamStdout}, multiplexWriter{out, logStreamStderr}
+	} else {
+		if _, err := io.Copy(out, s.src); logCopyError(err, s.stopped) != nil {
+			s.l.Log(grohl.Data{"at": "copy_log", "app_id": s.app.ID, "job_id": s.jobID, "error": err})
+		}
+		return
+	}
+	s.copy(s.streams.filter("stdout", s.grep.Writer(s.limit.Writer(stdout))), s.streams.filter("stderr", s.grep.Writer(s.limit.Writer(stderr))), s.stopped)
+	s.grep.Flush()
+	if s.limit.Truncated() {
+		stderr.Write([]byte(logTruncatedMarker))
+	}
+}
+
+// logStreams is the set of output streams requested from jobLog.
+type logStreams map[string]bool
+
+// parseLogStreams parses a comma separated list of stream names, an empty
+// list selects both stdout and stderr.
+func parseLogStreams(s string) (logStreams, error) {
+	if s == "" {
+		return logStreams{"stdout": true, "stderr": true}, nil
+	}
+	streams := make(logStreams, 2)
+	for _, name := range strings.Split(s, ",") {
+		if name != "stdout" && name != "stderr" {
+			return nil, ct.ValidationError{Field: "streams", Message: "must be stdout, stderr or both"}
+		}
+		streams[name] = true
+	}
+	return streams, nil
+}
+
+func (s logStreams) all() bool {
+	return s["stdout"] && s["stderr"]
+}
+
+// filter returns w if the named stream was requested and otherwise a writer
+// that discards the stream.
+func (s logStreams) filter(name string, w io.Writer) io.Writer {
+	if !s[name] {
+		return ioutil.Discard
+	}
+	return w
+}
+
+// defaultJobLogMaxBytes is how much log data jobLog sends for requests that
+// do not stream unless max_bytes is given.
+const defaultJobLogMaxBytes = 10 << 20
+
+// logTruncatedMarker is written to stderr, in the format of the response,
+// after log output that was cut short.
+const logTruncatedMarker = "...truncated\n"
+
+var errLogTruncated = errors.New("log output truncated")
+
+// logLimit caps the number of log bytes written through its writers, which
+// fail with errLogTruncated once the cap is reached. A nil logLimit does not
+// limit anything.
+type logLimit struct {
+	max       int64
+	written   int64
+	truncated bool
+}
+
+func (l *logLimit) Writer(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &logLimitWriter{l: l, w: w}
+}
+
+func (l *logLimit) Truncated() bool {
+	return l != nil && l.truncated
+}
+
+// logCopyError returns err if it means that a log stream broke, rather than
+// the output reaching its limit or the stream being closed because the client
+// went away.
+func logCopyError(err error, stopped <-chan struct{}) error {
+	if err == nil || err == errLogTruncated {
+		return nil
+	}
+	select {
+	case <-stopped:
+		return nil
+	default:
+	}
+	if err == io.EOF {
+		// demultiplex.Copy only returns EOF if a frame was cut short
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+type logLimitWriter struct {
+	l *logLimit
+	w io.Writer
+}
+
+func (w *logLimitWriter) Write(p []byte) (int, error) {
+	var truncated bool
+	if remaining := w.l.max - w.l.written; int64(len(p)) > remaining {
+		p = p[:remaining]
+		truncated = true
+	}
+	var n int
+	if len(p) > 0 {
+		var err error
+		n, err = w.w.Write(p)
+		w.l.written += int64(n)
+		if err != nil {
+			return n, err
+		}
+	}
+	if truncated {
+		w.l.truncated = true
+		return n, errLogTruncated
+	}
+	return n, nil
+}
+
+// maxGrepLine is the longest line that a logGrep buffers, longer lines are
+// matched in pieces.
+const maxGrepLine = 64 << 10
+
+// logGrep filters log output down to the lines that match re. A nil logGrep
+// does not filter anything.
+type logGrep struct {
+	re      *regexp.Regexp
+	writers []*logGrepWriter
+}
+
+func (g *logGrep) Writer(w io.Writer) io.Writer {
+	if g == nil {
+		return w
+	}
+	gw := &logGrepWriter{re: g.re, w: w}
+	g.writers = append(g.writers, gw)
+	return gw
+}
+
+// Flush writes the last line of each stream if it matches, it must be called
+// once the log has been copied as the line may not end in a newline.
+func (g *logGrep) Flush() {
+	if g == nil {
+		return
+	}
+	for _, w := range g.writers {
+		w.writeLine()
+	}
+}
+
+type logGrepWriter struct {
+	re   *regexp.Regexp
+	w    io.Writer
+	line []byte
+}
+
+func (w *logGrepWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.line = append(w.line, p...)
+			if len(w.line) < maxGrepLine {
+				break
+			}
+			p = nil
+		} else {
+			w.line = append(w.line, p[:i+1]...)
+			p = p[i+1:]
+		}
+		if err := w.writeLine(); err != nil {
+			return n - len(p), err
+		}
+	}
+	return n, nil
+}
+
+func (w *logGrepWriter) writeLine() error {
+	line := w.line
+	w.line = w.line[:0]
+	if len(line) == 0 || !w.re.Match(bytes.TrimSuffix(line, []byte("\n"))) {
+		return nil
+	}
+	_, err := w.w.Write(line)
+	return err
+}
+
+var (
+	// jobLogFollowPoll is how often a followed log looks for a replacement
+	// job, and jobLogFollowTimeout is how long it looks before giving up.
+	jobLogFollowPoll    = time.Second
+	jobLogFollowTimeout = 10 * time.Second
+)
+
+type sseLogSwitch struct {
+	JobID string `json:"job_id"`
+}
+
+// followJobLog streams the logs of jobs that replace the job with the given
+// composite ID, emitting a switch event before each one, until no
+// replacement of the same type turns up or gone is closed. It reports
+// whether it switched to another job.
+func followJobLog(l *grohl.Context, cc clusterClient, clk clock, appID, typ, lastID string, streams logStreams, grep *logGrep, ssew SSELogWriter, gone <-chan struct{}) bool {
+	seen := map[string]struct{}{lastID: {}}
+	followed := false
+	for {
+		next, ok := nextFollowJob(cc, clk, appID, typ, seen, gone)
+		if !ok {
+			return followed
+		}
+		id := utils.FormatJobID(next.hostID, next.jobID)
+		seen[id] = struct{}{}
+
+		client, err := cc.DialHost(next.hostID)
+		if err != nil {
+			l.Log(grohl.Data{"at": "connect_host", "host_id": next.hostID, "job_id": id, "error": err})
+			continue
+		}
+		logs, _, err := client.Attach(&host.AttachReq{
+			JobID: next.jobID,
+			Flags: host.AttachFlagStdout | host.AttachFlagStderr | host.AttachFlagLogs | host.AttachFlagStream,
+		}, false)
+		if err != nil {
+			l.Log(grohl.Data{"at": "attach", "host_id": next.hostID, "job_id": id, "error": err})
+			client.Close()
+			continue
+		}
+		l.Log(grohl.Data{"at": "switch", "host_id": next.hostID, "job_id": id})
+		followed = true
+		if err := ssew.Event("switch", &sseLogSwitch{JobID: id}); err != nil {
+			logs.Close()
+			client.Close()
+			return followed
+		}
+
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-gone:
+				logs.Close()
+			case <-done:
+			}
+		}()
+		demultiplex.Copy(streams.filter("stdout", grep.Writer(ssew.JobStream(id, "stdout"))), streams.filter("stderr", grep.Writer(ssew.JobStream(id, "stderr"))), logs)
+		grep.Flush()
+		close(done)
+		logs.Close()
+		client.Close()
+	}
+}
+
+// nextFollowJob waits for a job of the app with the given type that has not
+// been seen yet. Jobs are considered in the same order as jobList.
+func nextFollowJob(cc clusterClient, clk clock, appID, typ string, seen map[string]struct{}, gone <-chan struct{}) (sortJob, bool) {
+	deadline := clk.Now().Add(jobLogFollowTimeout)
+	for {
+		if hosts, err := cc.ListHosts(); err == nil {
+			var jobs sortJobs
+			for _, h := range hosts {
+				for _, j := range h.Jobs {
+					if _, ok := seen[utils.FormatJobID(h.ID, j.ID)]; ok {
+						continue
+					}
+					if j.Attributes["flynn-controller.app"] == appID && j.Attributes["flynn-controller.type"] == typ {
+						jobs = append(jobs, sortJob{hostID: h.ID, jobID: j.ID})
+					}
+				}
+			}
+			if len(jobs) > 0 {
+				sort.Sort(jobs)
+				return jobs[0], true
+			}
+		}
+		if clk.Now().After(deadline) {
+			return sortJob{}, false
+		}
+		select {
+		case <-gone:
+			return sortJob{}, false
+		case <-clk.After(jobLogFollowPoll):
+		}
+	}
+}
+
+// appLogPollInterval is how often appLog looks for new jobs to attach to
+// while streaming.
+var appLogPollInterval = 5 * time.Second
+
+// appLog streams the logs of all of an app's jobs. On the types route, only
+// the jobs of the process type are included, so that the log carries on
+// across deploys without the client knowing the job IDs.
+func appLog(req *http.Request, app *ct.App, params martini.Params, cc clusterClient, conf *logConfig, sessions *sessionRegistry, limiter *streamLimiter, clk clock, l *grohl.Context, w http.ResponseWriter, r ResponseHelper) {
+	stream := req.FormValue("stream") == "true"
+	timestamps := req.FormValue("timestamps") == "true"
+
+	hosts, err := cc.ListHosts()
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	if err := limiter.acquire(); err != nil {
+		r.Error(err)
+		return
+	}
+	defer limiter.release()
+
+	openLogStreams.Inc()
+	defer openLogStreams.Dec()
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	ssew := NewSSELogWriter(w, clk, timestamps)
+	flags := host.AttachFlagStdout | host.AttachFlagStderr | host.AttachFlagLogs
+	if stream {
+		flags |= host.AttachFlagStream
+	}
+	typ := params["types_id"]
+	agg := newLogAggregator(l.New(grohl.Data{"op": "app_log", "app_id": app.ID, "type": typ}), cc, ssew, app.ID, typ, flags)
+	shutdown := make(chan struct{})
+	defer sessions.add(func() {
+		close(shutdown)
+		agg.Close()
+	})()
+	agg.attach(hosts)
+
+	if stream {
+		stopKeepAlive, clientGone := make(chan struct{}), make(chan struct{})
+		go func() {
+			if err := ssew.KeepAlive(conf.keepAlive, stopKeepAlive); err != nil {
+				close(clientGone)
+			}
+		}()
+		var closeNotify <-chan bool
+		if cn, ok := w.(http.CloseNotifier); ok {
+			closeNotify = cn.CloseNotify()
+		}
+		ticker := clk.NewTicker(appLogPollInterval)
+	loop:
+		for {
+			select {
+			case <-ticker.C():
+				// jobs that have started since the last poll are added
+				// to the stream, jobs that went away have already
+				// dropped out of it
+				if hosts, err := cc.ListHosts(); err == nil {
+					agg.attach(hosts)
+				}
+			case <-closeNotify:
+				break loop
+			case <-clientGone:
+				break loop
+			case <-shutdown:
+				break loop
+			}
+		}
+		ticker.Stop()
+		close(stopKeepAlive)
+		agg.Close()
+	}
+	agg.Wait()
+
+	w.Write([]byte("event: eof\ndata: "))
+	json.NewEncoder(w).Encode(&sseLogEOF{})
+	w.Write([]byte("\n"))
+}
+
+type SSELogWriter interface {
+	Stream(string) io.Writer
+	JobStream(jobID, stream string) io.Writer
+	Event(name string, data interface{}) error
+	KeepAlive(interval time.Duration, stop <-chan struct{}) error
+}
+
+// mergedLogStream is the stream name of output from jobLog with merge set.
+const mergedLogStream = "combined"
+
+// mergedSSELogWriter labels chunks from both stdout and stderr as combined
+// output.
+type mergedSSELogWriter struct {
+	SSELogWriter
+}
+
+func (w mergedSSELogWriter) Stream(string) io.Writer {
+	return w.SSELogWriter.Stream(mergedLogStream)
+}
+
+func (w mergedSSELogWriter) JobStream(jobID, _ string) io.Writer {
+	return w.SSELogWriter.JobStream(jobID, mergedLogStream)
+}
+
+func NewSSELogWriter(w io.Writer, clk clock, timestamps bool) SSELogWriter {
+	sw := &sseLogWriter{Writer: w, Encoder: json.NewEncoder(w), clock: clk, timestamps: timestamps}
+	if f, ok := w.(http.Flusher); ok {
+		sw.flusher = f
+	}
+	return sw
+}
+
+// newResumableSSELogWriter returns an SSELogWriter that gives each chunk the
+// number of bytes of output up to its end as its ID. The host replays the log
+// from the start when a client reconnects, so the output up to lastID, which
+// the client has already seen, is skipped.
+func newResumableSSELogWriter(w io.Writer, clk clock, timestamps bool, lastID int64) SSELogWriter {
+	sw := NewSSELogWriter(w, clk, timestamps).(*sseLogWriter)
+	sw.ids = true
+	sw.skip = lastID
+	return sw
+}
+
+type sseLogWriter struct {
+	io.Writer
+	*json.Encoder
+	sync.Mutex
+	flusher    http.Flusher
+	clock      clock
+	timestamps bool
+	written    bool
+
+	ids       bool
+	pos, skip int64
+}
+
+// flush sends buffered output to the client, it must be called with the lock
+// held.
+func (w *sseLogWriter) flush() {
+	if w.flusher != nil {
+		w.flusher.Flush()
+	}
+}
+
+func (w *sseLogWriter) Stream(s string) io.Writer {
+	return &sseLogStreamWriter{w: w, s: s}
+}
+
+// JobStream returns a writer for chunks that are tagged with the job that
+// they came from.
+func (w *sseLogWriter) JobStream(jobID, s string) io.Writer {
+	return &sseLogStreamWriter{w: w, s: s, jobID: jobID}
+}
+
+// lag writes a lag event for output that was dropped by a logBuffer. The
+// dropped bytes still count towards chunk IDs, so a client can resume from
+// before them to get them back.
+func (w *sseLogWriter) lag(dropped int64) error {
+	w.Lock()
+	w.pos += dropped
+	seen := w.ids && w.pos <= w.skip
+	w.Unlock()
+	if seen {
+		return nil
+	}
+	return w.Event("lag", &sseLogLag{Dropped: dropped})
+}
+
+// Event writes a named event with JSON encoded data.
+func (w *sseLogWriter) Event(name string, data interface{}) error {
+	w.Lock()
+	defer w.Unlock()
+	w.written = true
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: ", name); err != nil {
+		return err
+	}
+	if err := w.Encode(data); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte("\n")); err != nil {
+		return err
+	}
+	w.flush()
+	return nil
+}
+
+// KeepAlive writes an SSE comment every interval in which no data was written
+// until stop is closed or a write fails.
+func (w *sseLogWriter) KeepAlive(interval time.Duration, stop <-chan struct{}) error {
+	ticker := w.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			w.Lock()
+			var err error
+			if !w.written {
+				if _, err = w.Write([]byte(":\n\n")); err == nil {
+					w.flush()
+				}
+			}
+			w.written = false
+			w.Unlock()
+			if err != nil {
+				return err
+			}
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+type sseLogStreamWriter struct {
+	w     *sseLogWriter
+	s     string
+	jobID string
+}
+
+type sseLogChunk struct {
+	JobID     string `json:"job_id,omitempty"`
+	Stream    string `json:"stream"`
+	Data      string `json:"data"`
+	Timestamp string `json:"timestamp,omitempty"`
+}
+
+type sseLogEOF struct {
+	ExitCode  *int `json:"exit_code,omitempty"`
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+type sseLogError struct {
+	Message string `json:"message"`
+}
+
+func (w *sseLogStreamWriter) Write(p []byte) (int, error) {
+	w.w.Lock()
+	defer w.w.Unlock()
+
+	n := len(p)
+	if w.w.ids {
+		start := w.w.pos
+		w.w.pos += int64(n)
+		if w.w.pos <= w.w.skip {
+			return n, nil
+		}
+		if start < w.w.skip {
+			p = p[w.w.skip-start:]
+		}
+		if _, err := fmt.Fprintf(w.w, "id: %d\n", w.w.pos); err != nil {
+			return 0, err
+		}
+	}
+	w.w.written = true
+	if _, err := w.w.Write([]byte("data: ")); err != nil {
+		return 0, err
+	}
+	chunk := &sseLogChunk{JobID: w.jobID, Stream: w.s, Data: string(p)}
+	if w.w.timestamps {
+		chunk.Timestamp = w.w.clock.Now().UTC().Format(time.RFC3339Nano)
+	}
+	if err := w.w.Encode(chunk); err != nil {
+		return 0, err
+	}
+	if _, err := w.w.Write([]byte("\n")); err != nil {
+		return 0, err
+	}
+	w.w.flush()
+	return n, nil
+}
+
+// ndjsonLogWriter writes each chunk of log output as a JSON object on its own
+// line.
+type ndjsonLogWriter struct {
+	sync.Mutex
+	enc        *json.Encoder
+	flusher    http.Flusher
+	clock      clock
+	timestamps bool
+}
+
+func newNDJSONLogWriter(w io.Writer, clk clock, timestamps bool) *ndjsonLogWriter {
+	jw := &ndjsonLogWriter{enc: json.NewEncoder(w), clock: clk, timestamps: timestamps}
+	if f, ok := w.(http.Flusher); ok {
+		jw.flusher = f
+	}
+	return jw
+}
+
+func (w *ndjsonLogWriter) Stream(s string) io.Writer {
+	return &ndjsonLogStreamWriter{w: w, s: s}
+}
+
+type ndjsonLogStreamWriter struct {
+	w *ndjsonLogWriter
+	s string
+}
+
+func (w *ndjsonLogStreamWriter) Write(p []byte) (int, error) {
+	w.w.Lock()
+	defer w.w.Unlock()
+
+	chunk := &sseLogChunk{Stream: w.s, Data: string(p)}
+	if w.w.timestamps {
+		chunk.Timestamp = w.w.clock.Now().UTC().Format(time.RFC3339Nano)
+	}
+	if err := w.w.enc.Encode(chunk); err != nil {
+		return 0, err
+	}
+	if w.w.flusher != nil {
+		w.w.flusher.Flush()
+	}
+	return len(p), nil
+}
+
+// protoLogMediaType is the Accept of clients that read logs as LogChunk
+// messages, each preceded by its length.
+const protoLogMediaType = "application/vnd.flynn.log+proto"
+
+// protoLogWriter writes each chunk of log output as a ct.LogChunk, it is
+// cheaper for machines to read at high volume than the JSON formats.
+type protoLogWriter struct {
+	sync.Mutex
+	w       io.Writer
+	flusher http.Flusher
+	clock   clock
+}
+
+func newProtoLogWriter(w io.Writer, clk clock) *protoLogWriter {
+	pw := &protoLogWriter{w: w, clock: clk}
+	if f, ok := w.(http.Flusher); ok {
+		pw.flusher = f
+	}
+	return pw
+}
+
+func (w *protoLogWriter) Stream(s string) io.Writer {
+	return &protoLogStreamWriter{w: w, s: s}
+}
+
+type protoLogStreamWriter struct {
+	w *protoLogWriter
+	s string
+}
+
+func (w *protoLogStreamWriter) Write(p []byte) (int, error) {
+	w.w.Lock()
+	defer w.w.Unlock()
+
+	chunk := &ct.LogChunk{Stream: w.s, Timestamp: w.w.clock.Now().UnixNano(), Data: p}
+	if err := ct.WriteLogChunk(w.w.w, chunk); err != nil {
+		return 0, err
+	}
+	if w.w.flusher != nil {
+		w.w.flusher.Flush()
+	}
+	return len(p), nil
+}
+
+func connectHostMiddleware(c martini.Context, params martini.Params, cl clusterClient, conf *hostConfig, l *grohl.Context, r ResponseHelper) {
+	hostID, jobID := utils.ParseJobID(params["jobs_id"])
+	if hostID == "" {
+		l.Log(grohl.Data{"op": "connect_host", "at": "parse_job_id", "job_id": params["jobs_id"]})
+		r.Error(ErrNotFound)
+		return
+	}
+	params["hosts_id"] = hostID
+	params["jobs_id"] = jobID
+
+	client, err := dialHost(cl, hostID, conf)
+	if err != nil {
+		l.Log(grohl.Data{"op": "connect_host", "at": "dial", "host_id": hostID, "error": err})
+		r.Error(err)
+		return
+	}
+	c.MapTo(client, (*cluster.Host)(nil))
+
+	c.Next()
+	client.Close()
+}
+
+// TTY sizes are kept within what terminals can draw, clients that don't give
+// a size get the traditional 24x80.
+const (
+	defaultTTYLines   = 24
+	defaultTTYColumns = 80
+	maxTTYSize        = 1000
+)
+
+// ttySize returns the lines and columns to give a job's TTY.
+func ttySize(lines, columns int) (int, int) {
+	return clampTTYSize(lines, defaultTTYLines), clampTTYSize(columns, defaultTTYColumns)
+}
+
+func clampTTYSize(n, def int) int {
+	switch {
+	case n <= 0:
+		return def
+	case n > maxTTYSize:
+		return maxTTYSize
+	}
+	return n
+}
+
+func killJob(app *ct.App, params martini.Params, client cluster.Host, l *grohl.Context, r ResponseHelper) {
+	rec := &resultRecorder{ResponseHelper: r}
+	r = rec
+	defer func() { killJobTotal.Inc(rec.result()) }()
+
+	l = l.New(grohl.Data{"op": "kill_job", "app_id": app.ID, "host_id": params["hosts_id"], "job_id": params["jobs_id"]})
+	l.Log(grohl.Data{"at": "stop"})
+	if err := stopError(client, params["jobs_id"], client.StopJob(params["jobs_id"])); err != nil {
+		r.Error(err)
+		return
+	}
+	r.NoContent()
+}
+
+func killJobs(app *ct.App, cc clusterClient, req *http.Request, l *grohl.Context, r ResponseHelper) {
+	typ := req.FormValue("type")
+	if typ == "" {
+		r.Error(ct.ValidationError{Field: "type", Message: "must not be blank"})
+		return
+	}
+	hosts, err := cc.ListHosts()
+	if err != nil {
+		r.Error(upstreamFailure("", "list hosts", err))
+		return
+	}
+
+	res := &ct.KillJobsResult{Failed: make(map[string]string)}
+	for _, h := range hosts {
+		var ids []string
+		for _, j := range h.Jobs {
+			if j.Attributes["flynn-controller.app"] == app.ID && j.Attributes["flynn-controller.type"] == typ {
+				ids = append(ids, j.ID)
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		client, err := cc.DialHost(h.ID)
+		if err != nil {
+			for _, id := range ids {
+				res.Failed[utils.FormatJobID(h.ID, id)] = err.Error()
+			}
+			continue
+		}
+		for _, id := range ids {
+			// jobs that have already gone count as killed, as in killJob
+			if err := stopError(client, id, client.StopJob(id)); err != nil {
+				res.Failed[utils.FormatJobID(h.ID, id)] = err.Error()
+				continue
+			}
+			res.Killed++
+		}
+		client.Close()
+	}
+	l.Log(grohl.Data{"op": "kill_jobs", "app_id": app.ID, "type": typ, "killed": res.Killed, "failed": len(res.Failed)})
+	if res.Killed == 0 && len(res.Failed) == 0 {
+		// there were no jobs of the type
+		r.NoContent()
+		return
+	}
+	r.JSON(200, res)
+}
+
+var jobExitPollInterval = 100 * time.Millisecond
+
+func jobExited(client cluster.Host, id string) (bool, error) {
+	jobs, err := client.ListJobs()
+	if err != nil {
+		return false, err
+	}
+	job, ok := jobs[id]
+	return !ok || job.Status != host.StatusStarting && job.Status != host.StatusRunning, nil
+}
+
+// maxJobMemory is the largest memory limit in bytes that may be requested for
+// a one-off job.
+const maxJobMemory = 1 << 40
+
+// maxJobCount is the largest number of replicas that a single request may
+// run.
+const maxJobCount = 100
+
+// jobMetaPrefix is prepended to the keys of a one-off job's meta to give the
+// host job attributes that they are stored in.
+const jobMetaPrefix = "flynn-controller.meta."
+
+// maxJobMetaBytes caps the combined size of the keys and values in a one-off
+// job's meta.
+const maxJobMetaBytes = 4096
+
+var jobMetaKeyPattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// jobUserPattern matches the user specs that docker accepts: a user name or
+// uid, optionally followed by a group name or gid.
+var jobUserPattern = regexp.MustCompile(`^([a-z_][a-z0-9_.-]{0,31}|[0-9]{1,10})(:([a-z_][a-z0-9_.-]{0,31}|[0-9]{1,10}))?$`)
+
+// runJobRequest is a job to run along with the options that were given in
+// the request's URL and headers.
+type runJobRequest struct {
+	*ct.NewJob
+	// attach is set when the client's connection is hijacked, either for a
+	// websocket or with an Accept of application/vnd.flynn.attach
+	attach           bool
+	dryRun           bool
+	killOnDisconnect bool
+	// pipeStdin is set when stdin is read from the request body, as there
+	// is no hijacked connection to read it from
+	pipeStdin bool
+	// progress is set for detached runs that report how the jobs are
+	// getting on instead of returning straight away
+	progress bool
+}
+
+// mode is how the client is connected to the run, for metrics.
+func (req *runJobRequest) mode() string {
+	switch {
+	case req.attach:
+		return "attached"
+	case req.pipeStdin:
+		return "stdin"
+	}
+	return "detached"
+}
+
+// count is the number of jobs to run.
+func (req *runJobRequest) count() int {
+	if req.Count == 0 {
+		return 1
+	}
+	return req.Count
+}
+
+// timeout is how long the jobs may run for, 0 if there is no limit.
+func (req *runJobRequest) timeout() time.Duration {
+	if req.Timeout <= 0 {
+		return 0
+	}
+	return time.Duration(req.Timeout) * time.Second
+}
+
+// Validate checks the job and reports every invalid field and every option
+// that cannot be combined with another.
+func (req *runJobRequest) Validate() ct.ValidationErrors {
+	newJob := req.NewJob
+	var errs ct.ValidationErrors
+	if len(newJob.Cmd) == 0 && len(newJob.Entrypoint) == 0 && newJob.Type == "" {
+		errs = append(errs, ct.ValidationError{Field: "cmd", Message: "is required"})
+	}
+	if newJob.Memory < 0 || newJob.Memory > maxJobMemory {
+		errs = append(errs, ct.ValidationError{Field: "memory", Message: fmt.Sprintf("must be between 1 and %d bytes", int64(maxJobMemory))})
+	}
+	if newJob.CPUShares < 0 {
+		errs = append(errs, ct.ValidationError{Field: "cpu_shares", Message: "must not be negative"})
+	}
+	if newJob.Timeout < 0 {
+		errs = append(errs, ct.ValidationError{Field: "timeout", Message: "must not be negative"})
+	}
+	if newJob.Count < 0 || newJob.Count > maxJobCount {
+		errs = append(errs, ct.ValidationError{Field: "count", Message: fmt.Sprintf("must be between 1 and %d", maxJobCount)})
+	} else if newJob.Count > 1 && (req.attach || newJob.Stdin) {
+		errs = append(errs, ct.ValidationError{Field: "count", Message: "must be 1 when attaching"})
+	}
+	if newJob.Columns < 0 {
+		errs = append(errs, ct.ValidationError{Field: "tty_columns", Message: "must not be negative"})
+	}
+	if newJob.Lines < 0 {
+		errs = append(errs, ct.ValidationError{Field: "tty_lines", Message: "must not be negative"})
+	}
+	if newJob.ReadOnlyTTY && newJob.Stdin {
+		errs = append(errs, ct.ValidationError{Field: "tty_read_only", Message: "cannot be used with stdin"})
+	}
+	if newJob.TTY && newJob.Stdin && !req.attach {
+		errs = append(errs, ct.ValidationError{Field: "tty", Message: "cannot be used with stdin unless attaching"})
+	}
+	if req.dryRun && req.attach {
+		errs = append(errs, ct.ValidationError{Field: "dry_run", Message: "cannot be used when attaching"})
+	} else if req.dryRun && newJob.Stdin {
+		errs = append(errs, ct.ValidationError{Field: "dry_run", Message: "cannot be used with stdin"})
+	}
+	if newJob.UseReleaseMounts && len(newJob.ReleaseMounts) > 0 {
+		errs = append(errs, ct.ValidationError{Field: "release_mounts", Message: "cannot be used with use_release_mounts"})
+	}
+	if req.killOnDisconnect && !req.attach {
+		errs = append(errs, ct.ValidationError{Field: "kill_on_disconnect", Message: "requires attaching"})
+	}
+	if newJob.User != "" && !jobUserPattern.MatchString(newJob.User) {
+		errs = append(errs, ct.ValidationError{Field: "user", Message: "must be a user name or uid, optionally followed by :group or :gid"})
+	}
+	if !boolDefault(newJob.Stdout, true) && !boolDefault(newJob.Stderr, true) {
+		errs = append(errs, ct.ValidationError{Field: "stdout", Message: "or stderr must be enabled"})
+	}
+	keys := make([]string, 0, len(newJob.Meta))
+	size := 0
+	for k, v := range newJob.Meta {
+		keys = append(keys, k)
+		size += len(k) + len(v)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !jobMetaKeyPattern.MatchString(k) {
+			errs = append(errs, ct.ValidationError{Field: "meta." + k, Message: "must only contain letters, digits, '.', '_' and '-'"})
+		}
+	}
+	if size > maxJobMetaBytes {
+		errs = append(errs, ct.ValidationError{Field: "meta", Message: fmt.Sprintf("must not be more than %d bytes", maxJobMetaBytes)})
+	}
+	return errs
+}
+
+// validateMounts checks the mounts of a release that a job has asked to use.
+// The release doesn't describe the files in its image, so mount paths are
+// checked against each other and what docker accepts, not against the image.
+func validateMounts(mounts []ct.Mount) ct.ValidationErrors {
+	var errs ct.ValidationErrors
+	seen := make(map[string]bool, len(mounts))
+	for i, m := range mounts {
+		field := fmt.Sprintf("release.mounts[%d]", i)
+		if !validMountPath(m.Path) {
+			errs = append(errs, ct.ValidationError{Field: field + ".path", Message: "must be an absolute path"})
+		} else if seen[path.Clean(m.Path)] {
+			errs = append(errs, ct.ValidationError{Field: field + ".path", Message: "is mounted more than once"})
+		}
+		seen[path.Clean(m.Path)] = true
+		if m.Source != "" && !validMountPath(m.Source) {
+			errs = append(errs, ct.ValidationError{Field: field + ".source", Message: "must be an absolute path"})
+		}
+	}
+	return errs
+}
+
+// selectMounts returns the release mounts at paths, or an error for each of
+// the paths that the release doesn't mount.
+func selectMounts(mounts []ct.Mount, paths []string) ([]ct.Mount, ct.ValidationErrors) {
+	byPath := make(map[string]ct.Mount, len(mounts))
+	for _, m := range mounts {
+		byPath[path.Clean(m.Path)] = m
+	}
+	var selected []ct.Mount
+	var errs ct.ValidationErrors
+	for i, p := range paths {
+		m, ok := byPath[path.Clean(p)]
+		if !ok {
+			errs = append(errs, ct.ValidationError{Field: fmt.Sprintf("release_mounts[%d]", i), Message: "is not mounted by the release"})
+			continue
+		}
+		selected = append(selected, m)
+	}
+	return selected, errs
+}
+
+// validMountPath reports whether p can be used in a docker bind, which
+// separates its fields with colons.
+func validMountPath(p string) bool {
+	return path.IsAbs(p) && !strings.Contains(p, ":")
+}
+
+// boolDefault returns the value of an optional boolean, or def if it is unset.
+func boolDefault(b *bool, def bool) bool {
+	if b == nil {
+		return def
+	}
+	return *b
+}
+
+// watchJobTimeout stops a job if it is still running once timeout has
+// elapsed. It returns early if the host reports that the job has stopped.
+func watchJobTimeout(l *grohl.Context, cl clusterClient, clk clock, hostID, jobID string, timeout time.Duration) {
+	client, err := cl.DialHost(hostID)
+	if err != nil {
+		l.Log(grohl.Data{"at": "connect_host", "error": err})
+		return
+	}
+	defer client.Close()
+
+	events := make(chan *host.Event)
+	if stream := client.StreamEvents(jobID, events); stream != nil {
+		defer stream.Close()
+	}
+	expired := clk.After(timeout)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				// the event stream failed, rely on the timer alone
+				events = nil
+				continue
+			}
+			if e.JobID == jobID && (e.Event == "stop" || e.Event == "error") {
+				return
+			}
+		case <-expired:
+			if exited, err := jobExited(client, jobID); err == nil && exited {
+				return
+			}
+			l.Log(grohl.Data{"at": "stop"})
+			if err := client.StopJob(jobID); err != nil {
+				l.Log(grohl.Data{"at": "stop", "error": err})
+			}
+			return
+		}
+	}
+}
+
+// jobPlacement is a job and the host that it is scheduled on. It is also the
+// response to a dry run of runJob.
+type jobPlacement struct {
+	HostID string    `json:"host_id"`
+	Job    *host.Job `json:"job"`
+}
+
+// replicateJob returns a copy of job with a new ID.
+func replicateJob(job *host.Job) *host.Job {
+	j := *job
+	j.ID = cluster.RandomJobID("")
+	j.Attributes = make(map[string]string, len(job.Attributes))
+	for k, v := range job.Attributes {
+		j.Attributes[k] = v
+	}
+	config := *job.Config
+	j.Config = &config
+	return &j
+}
+
+// jobStdin is what follows the job in the body of a runJob request, it is
+// sent to the job's stdin if NewJob.Stdin is set.
+type jobStdin struct {
+	io.Reader
+}
+
+// maxJobBodySize is the largest job that runJob accepts, stdin data after the
+// job is not limited.
+const maxJobBodySize = 1 << 20
+
+// RequestTooLargeError is returned when a request body is over its limit.
+type RequestTooLargeError struct {
+	Limit int64
+}
+
+func (e *RequestTooLargeError) Error() string {
+	return fmt.Sprintf("the request body is larger than %d bytes", e.Limit)
+}
+
+// splitJobBody separates the job at the start of a runJob request body from
+// the stdin data after it. The job is left as the body to be bound.
+func splitJobBody(c martini.Context, req *http.Request, w http.ResponseWriter, r ResponseHelper) {
+	stdin := jobStdin{strings.NewReader("")}
+	if req.Body != nil {
+		var read bytes.Buffer
+		dec := json.NewDecoder(io.TeeReader(http.MaxBytesReader(w, req.Body, maxJobBodySize), &read))
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if _, ok := err.(*json.SyntaxError); ok {
+			r.Error(err)
+			return
+		}
+		switch {
+		case err == nil:
+			stdin.Reader = io.MultiReader(dec.Buffered(), req.Body)
+			req.Body = readCloser{bytes.NewReader(raw), req.Body}
+		case read.Len() >= maxJobBodySize:
+			r.Error(&RequestTooLargeError{Limit: maxJobBodySize})
+			return
+		default:
+			// leave the invalid body as it was for binding to report on
+			req.Body = readCloser{io.MultiReader(&read, req.Body), req.Body}
+		}
+	}
+	c.Map(stdin)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// jobSource provides the release and artifact that runJob runs a job from.
+type jobSource interface {
+	jobRelease(newJob *ct.NewJob) (*ct.Release, *ct.Artifact, error)
+}
+
+// releaseJobSource runs jobs from the release that they name.
+type releaseJobSource struct {
+	releases  *ReleaseRepo
+	artifacts *ArtifactRepo
+}
+
+func (s releaseJobSource) jobRelease(newJob *ct.NewJob) (*ct.Release, *ct.Artifact, error) {
+	data, err := s.releases.Get(newJob.ReleaseID)
+	if err != nil {
+		return nil, nil, err
+	}
+	release := data.(*ct.Release)
+	data, err = s.artifacts.Get(release.ArtifactID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return release, data.(*ct.Artifact), nil
+}
+
+// imageJobSource runs jobs straight from an artifact URI, with an empty
+// release.
+type imageJobSource struct {
+	uri string
+}
+
+func (s imageJobSource) jobRelease(*ct.NewJob) (*ct.Release, *ct.Artifact, error) {
+	return &ct.Release{}, &ct.Artifact{Type: "docker", URI: s.uri}, nil
+}
+
+// runImageMiddleware prepares a runimage request for runJob. It is an escape
+// hatch for operators that need to run an image outside of the app's
+// releases.
+func runImageMiddleware(c martini.Context, job ct.NewImageJob, r ResponseHelper) {
+	var errs ct.ValidationErrors
+	if job.ReleaseID != "" {
+		errs = append(errs, ct.ValidationError{Field: "release", Message: "cannot be used when running an image"})
+	}
+	if job.ArtifactURI == "" {
+		errs = append(errs, ct.ValidationError{Field: "artifact_uri", Message: "is required"})
+	} else if _, err := utils.DockerImage(job.ArtifactURI); err != nil {
+		errs = append(errs, ct.ValidationError{Field: "artifact_uri", Message: imageURIMessage(err)})
+	}
+	if len(errs) > 0 {
+		r.Error(errs)
+		return
+	}
+	c.Map(job.NewJob)
+	c.MapTo(imageJobSource{uri: job.ArtifactURI}, (*jobSource)(nil))
+}
+
+func imageURIMessage(err error) string {
+	msg := "is invalid"
+	if e, ok := err.(*utils.ImageURIError); ok {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+func runJob(app *ct.App, newJob ct.NewJob, stdin jobStdin, source jobSource, deps *jobDeps, l *grohl.Context, req *http.Request, w http.ResponseWriter, r ResponseHelper) {
+	l = l.New(grohl.Data{"op": "run_job", "app_id": app.ID})
+	rec := &resultRecorder{ResponseHelper: r}
+	r = rec
+	mode := "detached"
+	defer func() { runJobTotal.Inc(mode, rec.result()) }()
+
+	run, err := parseRunJobRequest(req, &newJob)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	mode = run.mode()
+	// validation errors are collected and returned together once the
+	// request has been checked against the release and the cluster
+	errs := run.Validate()
+	release, artifact, err := source.jobRelease(&newJob)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	if _, ok := w.(http.Hijacker); run.attach && !ok {
+		r.Error(errors.New("attach failed: connection does not support hijacking"))
+		return
+	}
+	count := run.count()
+	// the response to a retried request is what the first attempt returned,
+	// attached and dry runs have nothing that can be replayed
+	var result interface{}
+	if key := req.Header.Get("Idempotency-Key"); key != "" && !run.attach && !run.pipeStdin && !run.dryRun {
+		key = app.ID + ":" + key
+		if res, ok := deps.idempotency.begin(key); ok {
+			l.Log(grohl.Data{"at": "idempotent_replay"})
+			r.JSON(200, res)
+			return
+		}
+		defer func() { deps.idempotency.finish(key, result) }()
+	}
+
+	job, jobErrs := newRunJob(l, run, app, release, artifact, deps.conf, deps.clock)
+	errs = append(errs, jobErrs...)
+	jobs := []*host.Job{job}
+	for i := 1; i < count; i++ {
+		jobs = append(jobs, replicateJob(job))
+	}
+
+	hosts, err := deps.cluster.ListHosts()
+	if err != nil {
+		r.Error(upstreamFailure("", "list hosts", err))
+		return
+	}
+	// hosts that already have a job bound to one of the job's ports would
+	// fail to start it
+	ports := hostPorts(job)
+	matched := freePortHosts(matchHosts(schedulableHosts(hosts), newJob.Constraints), ports)
+	if newJob.HostID != "" && len(hosts) > 0 {
+		if err := validateRunHost(newJob.HostID, hosts, matched, ports); err != nil {
+			errs = append(errs, *err)
+		}
+	}
+	if len(errs) > 0 {
+		r.Error(errs)
+		return
+	}
+	if len(hosts) == 0 {
+		r.Error(ErrNoHosts)
+		return
+	}
+	if limit := appJobLimit(app, deps.conf.maxAppJobs); limit > 0 {
+		if running := countOneOffJobs(hosts, app.ID); running+count > limit {
+			l.Log(grohl.Data{"at": "job_limit", "limit": limit, "running": running})
+			r.Error(&JobLimitError{Limit: limit})
+			return
+		}
+	}
+	placements, pool, err := placeRunJobs(deps.sched, newJob.HostID, matched, jobs)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	if run.dryRun {
+		if count == 1 {
+			r.JSON(200, &placements[0])
+		} else {
+			r.JSON(200, placements)
+		}
+		return
+	}
+	hostID := placements[0].HostID
+
+	var client cluster.Host
+	var attachConn cluster.ReadWriteCloser
+	var attachWait func() error
+	if run.attach || run.pipeStdin {
+		if err := deps.limiter.acquire(); err != nil {
+			r.Error(err)
+			return
+		}
+		defer deps.limiter.release()
+		client, attachConn, attachWait, err = attachRunJob(deps.cluster, deps.hostConf, run, job, hostID)
+		if err != nil {
+			r.Error(err)
+			return
+		}
+		defer client.Close()
+		defer attachConn.Close()
+		// the client is already attached to the chosen host, so the job
+		// cannot be moved
+		pool = nil
+	}
+
+	placements, err = addJobsWithRetry(l, deps.cluster, deps.clock, deps.sched, pool, placements)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	timeout := run.timeout()
+	for _, p := range placements {
+		l.Log(grohl.Data{"at": "scheduled", "host_id": p.HostID, "job_id": p.Job.ID, "attach": run.attach})
+		if mode == "detached" {
+			// nobody is attached to see how the job ends, so keep a record
+			// once it exits
+			deps.exits.watch(deps.history, app.ID, p.HostID, p.Job.ID)
+		}
+		if timeout > 0 {
+			// the watcher is independent of the request so that the timeout
+			// still applies if an attached client disconnects
+			go watchJobTimeout(l.New(grohl.Data{"op": "job_timeout", "host_id": p.HostID, "job_id": p.Job.ID}), deps.cluster, deps.clock, p.HostID, p.Job.ID, timeout)
+		}
+	}
+
+	if run.attach || run.pipeStdin {
+		if err := attachWait(); err != nil {
+			r.Error(upstreamFailure(hostID, "attach wait", err))
+			return
+		}
+		l := l.New(grohl.Data{"host_id": hostID, "job_id": job.ID})
+		if run.pipeStdin {
+			defer deps.sessions.add(func() { attachConn.Close() })()
+			w.Header().Set("Content-Type", "application/octet-stream")
+			if err := pipeJobStdin(w, stdin, attachConn); err != nil {
+				l.Log(grohl.Data{"at": "pipe_stdin", "error": err})
+			}
+			return
+		}
+		if serveAttach(l, deps.sessions, deps.clock, w, req, attachConn, r) {
+			l.Log(grohl.Data{"at": "client_disconnected", "kill": run.killOnDisconnect})
+			if run.killOnDisconnect {
+				if err := client.StopJob(job.ID); err != nil {
+					l.Log(grohl.Data{"at": "stop", "error": err})
+				}
+			}
+		}
+		return
+	}
+
+	res := runJobResult(&newJob, placements, hosts)
+	if count == 1 {
+		result = res[0]
+	} else {
+		result = res
+	}
+	if run.progress {
+		streamJobProgress(deps.cluster, deps.hostConf, deps.logConf, deps.sessions, deps.clock, l, w, res)
+		return
+	}
+	r.JSON(200, result)
+}
+
+// parseRunJobRequest reads the options of a run from the request's URL and
+// headers.
+func parseRunJobRequest(req *http.Request, newJob *ct.NewJob) (*runJobRequest, error) {
+	websocket := isWebSocketUpgrade(req)
+	if websocket {
+		if err := validateWebSocketRequest(req); err != nil {
+			return nil, err
+		}
+	} else if err := checkAccept(req, runJobMediaTypes...); err != nil {
+		return nil, err
+	}
+	run := &runJobRequest{
+		NewJob:           newJob,
+		attach:           websocket || strings.Contains(req.Header.Get("Accept"), "application/vnd.flynn.attach"),
+		dryRun:           req.FormValue("dry_run") == "true",
+		killOnDisconnect: req.FormValue("kill_on_disconnect") == "true",
+	}
+	// without a hijacked connection, stdin is read from the request body
+	run.pipeStdin = newJob.Stdin && !run.attach
+	// detached runs can report how the jobs are getting on instead of
+	// returning straight away
+	run.progress = !run.attach && !run.pipeStdin && !run.dryRun && strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+	return run, nil
+}
+
+// newRunJob builds the host job for a run of the release. The parts of the
+// request that can only be checked against the release are checked here.
+func newRunJob(l *grohl.Context, run *runJobRequest, app *ct.App, release *ct.Release, artifact *ct.Artifact, conf *jobConfig, clk clock) (*host.Job, ct.ValidationErrors) {
+	newJob := run.NewJob
+	var errs ct.ValidationErrors
+	if newJob.Type != "" {
+		// the process type's command is the default, an explicit cmd
+		// still overrides it
+		if proc, ok := release.Processes[newJob.Type]; !ok {
+			errs = append(errs, ct.ValidationError{Field: "type", Message: "is not a process type of the release"})
+		} else if len(newJob.Cmd) == 0 {
+			newJob.Cmd = proc.Cmd
+		}
+	}
+	image, err := utils.DockerImage(artifact.URI)
+	if err != nil {
+		l.Log(grohl.Data{"at": "parse_artifact_uri", "error": err})
+		errs = append(errs, ct.ValidationError{
+			Field:   "artifact.uri",
+			Message: imageURIMessage(err),
+		})
+	}
+
+	job := &host.Job{
+		ID: cluster.RandomJobID(""),
+		Attributes: map[string]string{
+			"flynn-controller.app":        app.ID,
+			"flynn-controller.release":    release.ID,
+			"flynn-controller.created_at": clk.Now().UTC().Format(time.RFC3339),
+		},
+		Config: &docker.Config{
+			Entrypoint:   newJob.Entrypoint,
+			Cmd:          newJob.Cmd,
+			Env:          utils.FormatEnv(conf.env, release.Env, newJob.Env),
+			Image:        image,
+			AttachStdout: boolDefault(newJob.Stdout, true),
+			AttachStderr: boolDefault(newJob.Stderr, true),
+		},
+	}
+	for k, v := range newJob.Meta {
+		job.Attributes[jobMetaPrefix+k] = v
+	}
+	if newJob.Memory > 0 {
+		job.Config.Memory = newJob.Memory
+		job.Attributes["flynn-controller.memory"] = strconv.FormatInt(newJob.Memory, 10)
+	}
+	if newJob.CPUShares > 0 {
+		job.Config.CpuShares = newJob.CPUShares
+		job.Attributes["flynn-controller.cpu_shares"] = strconv.FormatInt(newJob.CPUShares, 10)
+	}
+	if newJob.User != "" {
+		job.Config.User = newJob.User
+		job.Attributes["flynn-controller.user"] = newJob.User
+	}
+	if timeout := run.timeout(); timeout > 0 {
+		job.Attributes["flynn-controller.deadline"] = clk.Now().Add(timeout).UTC().Format(time.RFC3339)
+	}
+	if newJob.TTY || newJob.ReadOnlyTTY {
+		job.Config.Tty = true
+	}
+	if run.attach && !newJob.ReadOnlyTTY || run.pipeStdin {
+		job.Config.AttachStdin = true
+		job.Config.StdinOnce = true
+		job.Config.OpenStdin = true
+	}
+	if proc, ok := release.Processes[newJob.Type]; ok {
+		// one-off jobs of a process type bind the same host ports as the
+		// type's formation jobs
+		utils.SetProcessHostPorts(job, proc)
+	}
+	if len(hostPorts(job)) > 0 && run.count() > 1 {
+		// the jobs could be placed on the same host
+		errs = append(errs, ct.ValidationError{Field: "count", Message: "must be 1 when binding host ports"})
+	}
+	if newJob.UseReleaseMounts || len(newJob.ReleaseMounts) > 0 {
+		mounts := release.Mounts
+		var mountErrs ct.ValidationErrors
+		if len(newJob.ReleaseMounts) > 0 {
+			mounts, mountErrs = selectMounts(mounts, newJob.ReleaseMounts)
+		} else if len(mounts) == 0 {
+			mountErrs = ct.ValidationErrors{{Field: "use_release_mounts", Message: "the release has no mounts"}}
+		}
+		if len(mountErrs) == 0 {
+			mountErrs = validateMounts(release.Mounts)
+		}
+		if len(mountErrs) > 0 {
+			errs = append(errs, mountErrs...)
+		} else {
+			utils.SetMounts(job, mounts)
+		}
+	}
+	return job, errs
+}
+
+// validateRunHost checks the host that a run asked to be placed on.
+func validateRunHost(hostID string, hosts, matched map[string]host.Host, ports []string) *ct.ValidationError {
+	h, ok := hosts[hostID]
+	switch {
+	case !ok:
+		return &ct.ValidationError{Field: "host_id", Message: "not found"}
+	case hostDraining(h):
+		return &ct.ValidationError{Field: "host_id", Message: "is being drained"}
+	}
+	if port := hostPortConflict(h, ports); port != "" {
+		return &ct.ValidationError{Field: "host_id", Message: "is already using port " + port}
+	}
+	if _, ok := matched[hostID]; !ok {
+		return &ct.ValidationError{Field: "host_id", Message: "does not match the constraints"}
+	}
+	return nil
+}
+
+// placeRunJobs puts the jobs of a run on the host that was asked for, or
+// spreads them over the matched hosts. The pool that they may be moved within
+// is nil when the host was chosen by the client, as the jobs cannot be moved
+// elsewhere.
+func placeRunJobs(sched scheduler, hostID string, matched map[string]host.Host, jobs []*host.Job) ([]jobPlacement, map[string]host.Host, error) {
+	if hostID != "" {
+		placements := make([]jobPlacement, 0, len(jobs))
+		for _, j := range jobs {
+			placements = append(placements, jobPlacement{hostID, j})
+		}
+		return placements, nil, nil
+	}
+	if len(matched) == 0 {
+		return nil, nil, ErrNoHosts
+	}
+	pool := make(map[string]host.Host, len(matched))
+	for id, h := range matched {
+		pool[id] = h
+	}
+	placements, err := placeJobs(sched, pool, jobs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return placements, pool, nil
+}
+
+// attachRunJob attaches to a job on its host before the job is added, so
+// that none of its output is missed. The caller closes the client and the
+// connection, and calls wait once the job has been added.
+func attachRunJob(cl clusterClient, hostConf *hostConfig, run *runJobRequest, job *host.Job, hostID string) (cluster.Host, cluster.ReadWriteCloser, func() error, error) {
+	newJob := run.NewJob
+	attachReq := &host.AttachReq{
+		JobID:  job.ID,
+		Flags:  host.AttachFlagStream,
+		Height: newJob.Lines,
+		Width:  newJob.Columns,
+	}
+	if job.Config.Tty {
+		attachReq.Height, attachReq.Width = ttySize(newJob.Lines, newJob.Columns)
+	}
+	if !newJob.ReadOnlyTTY {
+		attachReq.Flags |= host.AttachFlagStdin
+	}
+	if job.Config.AttachStdout {
+		attachReq.Flags |= host.AttachFlagStdout
+	}
+	if job.Config.AttachStderr {
+		attachReq.Flags |= host.AttachFlagStderr
+	}
+	client, err := dialHost(cl, hostID, hostConf)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	conn, wait, err := attachHost(client, hostID, attachReq, true, hostConf)
+	if err != nil {
+		client.Close()
+		return nil, nil, nil, upstreamFailure(hostID, "attach", err)
+	}
+	if newJob.ReadOnlyTTY {
+		// the job has no stdin, so nothing is sent its way
+		conn.CloseWrite()
+		conn = readOnlyAttach{conn}
+	}
+	return client, conn, wait, nil
+}
+
+// runJobResult is the job of each placement, as returned to a detached run.
+func runJobResult(newJob *ct.NewJob, placements []jobPlacement, hosts map[string]host.Host) []*ct.Job {
+	res := make([]*ct.Job, len(placements))
+	for i, p := range placements {
+		res[i] = &ct.Job{
+			ID:        utils.FormatJobID(p.HostID, p.Job.ID),
+			HostID:    p.HostID,
+			JobID:     p.Job.ID,
+			ReleaseID: newJob.ReleaseID,
+			Cmd:       newJob.Cmd,
+			Meta:      newJob.Meta,
+			Host:      &ct.JobHost{ID: p.HostID, Attributes: hosts[p.HostID].Attributes},
+		}
+	}
+	return res
+}
+
+// pipeJobStdin sends stdin to the job attached to conn, closes the job's
+// stdin and writes the job's output to w until it exits. net/http does not
+// allow the request body to be read once the response has started, so output
+// that arrives while stdin is being sent is held back until it has been.
+func pipeJobStdin(w http.ResponseWriter, stdin io.Reader, conn cluster.ReadWriteCloser) error {
+	out := &heldWriter{}
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(out, conn)
+		done <- err
+	}()
+	_, err := io.Copy(conn, stdin)
+	if err != nil {
+		// the job stopped reading, but the rest of the body must still
+		// be consumed before responding
+		io.Copy(ioutil.Discard, stdin)
+	}
+	if e := conn.CloseWrite(); err == nil {
+		err = e
+	}
+
+	w.WriteHeader(200)
+	var f http.Flusher
+	if fw, ok := w.(http.Flusher); ok {
+		f = fw
+	}
+	if e := out.release(flushWriter{w, f}); err == nil {
+		err = e
+	}
+	if e := <-done; err == nil {
+		err = e
+	}
+	return err
+}
+
+// heldWriter buffers what is written to it until release is called, and
+// then passes writes straight on.
+type heldWriter struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+	w   io.Writer
+}
+
+func (h *heldWriter) Write(p []byte) (int, error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.w == nil {
+		return h.buf.Write(p)
+	}
+	return h.w.Write(p)
+}
+
+func (h *heldWriter) release(w io.Writer) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.w = w
+	_, err := h.buf.WriteTo(w)
+	return err
+}
+
+// flushWriter flushes after each write so that output is not held up in the
+// response buffer.
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (w flushWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if w.f != nil {
+		w.f.Flush()
+	}
+	return n, err
+}
+
+// appJobMaxAttr is the app meta key that overrides the controller wide cap on
+// one-off jobs, 0 lifts the cap for the app.
+const appJobMaxAttr = "flynn-controller.max_jobs"
+
+func appJobLimit(app *ct.App, def int) int {
+	if n, err := strconv.Atoi(app.Meta[appJobMaxAttr]); err == nil && n >= 0 {
+		return n
+	}
+	return def
+}
+
+// countOneOffJobs counts the jobs that the app is running outside of its
+// formation.
+func countOneOffJobs(hosts map[string]host.Host, appID string) int {
+	var n int
+	for _, h := range hosts {
+		for _, j := range h.Jobs {
+			if j.Attributes["flynn-controller.app"] == appID && j.Attributes["flynn-controller.type"] == "" {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// JobLimitError is returned when running a job would take an app over its cap
+// on one-off jobs.
+type JobLimitError struct {
+	Limit int
+}
+
+func (e *JobLimitError) Error() string {
+	return fmt.Sprintf("too many one-off jobs, the limit is %d", e.Limit)
+}
+
+// HostDialError is returned when a host cannot be connected to.
+type HostDialError struct {
+	HostID string
+	Err    error
+}
+
+func (e *HostDialError) Error() string {
+	return fmt.Sprintf("lorne connect failed: host %s: %s", e.HostID, e.Err)
+}
+
+// dialHost connects to the host with the given ID, giving up after timeout.
+// Failures other than the host not existing are returned as a
+// *HostDialError, and a connection that is made after giving up is closed.
+func dialHost(cl clusterClient, hostID string, conf *hostConfig) (cluster.Host, error) {
+	type result struct {
+		client cluster.Host
+		err    error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		client, err := cl.DialHost(hostID)
+		ch <- result{client, err}
+	}()
+	select {
+	case res := <-ch:
+		if res.err != nil && res.err != ErrNotFound {
+			return nil, &HostDialError{HostID: hostID, Err: res.err}
+		}
+		return res.client, res.err
+	case <-conf.clock.After(conf.dialTimeout):
+		go func() {
+			if res := <-ch; res.client != nil {
+				res.client.Close()
+			}
+		}()
+		return nil, &HostTimeoutError{HostID: hostID, Op: "connect"}
+	}
+}
+
+// attachHost attaches to a job like client.Attach, giving up after timeout.
+// An attach that completes after giving up is closed.
+func attachHost(client cluster.Host, hostID string, req *host.AttachReq, wait bool, conf *hostConfig) (cluster.ReadWriteCloser, func() error, error) {
+	type result struct {
+		conn cluster.ReadWriteCloser
+		wait func() error
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, wait, err := client.Attach(req, wait)
+		ch <- result{conn, wait, err}
+	}()
+	select {
+	case res := <-ch:
+		return res.conn, res.wait, res.err
+	case <-conf.clock.After(conf.attachTimeout):
+		go func() {
+			if res := <-ch; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, nil, &HostTimeoutError{HostID: hostID, Op: "attach"}
+	}
+}
+
+// HostTimeoutError is returned when a host takes too long to respond.
+type HostTimeoutError struct {
+	HostID string
+	Op     string
+}
+
+func (e *HostTimeoutError) Error() string {
+	return fmt.Sprintf("host %s: %s timed out", e.HostID, e.Op)
+}
+
+// ScheduleError is returned when the cluster accepted a request to add a job
+// but did not schedule it.
+type ScheduleError struct {
+	HostID string
+	JobID  string
+	Reason string
+}
+
+func (e *ScheduleError) Error() string {
+	return fmt.Sprintf("job %s was not scheduled on host %s: %s", e.JobID, e.HostID, e.Reason)
+}
+
+// placeJobs picks a host in pool for each job. The jobs placed so far are
+// added to pool so that replicas are spread out.
+func placeJobs(sched scheduler, pool map[string]host.Host, jobs []*host.Job) ([]jobPlacement, error) {
+	placements := make([]jobPlacement, 0, len(jobs))
+	for _, j := range jobs {
+		hostID, err := sched.PickHost(pool, j)
+		if err != nil {
+			return nil, err
+		}
+		if h, ok := pool[hostID]; ok {
+			h.Jobs = append(append(make([]*host.Job, 0, len(h.Jobs)+1), h.Jobs...), j)
+			pool[hostID] = h
+		}
+		placements = append(placements, jobPlacement{hostID, j})
+	}
+	return placements, nil
+}
+
+// scheduleAttempts is how many times jobs are offered to the cluster before a
+// transient failure is given up on. The delay before each retry starts at
+// scheduleRetryDelay and doubles.
+var (
+	scheduleAttempts   = 3
+	scheduleRetryDelay = 100 * time.Millisecond
+)
+
+// addJobsWithRetry adds the placed jobs to the cluster, returning the
+// placements that were scheduled. If pool is not nil, jobs that fail for a
+// transient reason are moved to other hosts in pool and tried again, the hosts
+// that they failed on are removed from pool.
+func addJobsWithRetry(l *grohl.Context, cl clusterClient, clk clock, sched scheduler, pool map[string]host.Host, placements []jobPlacement) ([]jobPlacement, error) {
+	scheduled := make([]jobPlacement, 0, len(placements))
+	delay := scheduleRetryDelay
+	for attempt := 1; ; attempt++ {
+		ok, failed, err := addJobs(l, cl, placements)
+		scheduled = append(scheduled, ok...)
+		if err == nil {
+			return scheduled, nil
+		}
+		if pool == nil || attempt >= scheduleAttempts || !retryableScheduleError(err) {
+			return scheduled, scheduleFailure(err)
+		}
+		jobs := make([]*host.Job, len(failed))
+		for i, p := range failed {
+			delete(pool, p.HostID)
+			jobs[i] = p.Job
+		}
+		next, perr := placeJobs(sched, pool, jobs)
+		if perr != nil {
+			// there is nowhere else to put the jobs
+			return scheduled, scheduleFailure(err)
+		}
+		placements = next
+		l.Log(grohl.Data{"at": "schedule_retry", "attempt": attempt, "error": err})
+		<-clk.After(delay)
+		delay *= 2
+	}
+}
+
+// addJobs makes a single attempt at adding the placed jobs to the cluster. It
+// returns the placements that were accepted and those that were not.
+func addJobs(l *grohl.Context, cl clusterClient, placements []jobPlacement) (ok, failed []jobPlacement, err error) {
+	hostJobs := make(map[string][]*host.Job)
+	for _, p := range placements {
+		hostJobs[p.HostID] = append(hostJobs[p.HostID], p.Job)
+	}
+	res, err := cl.AddJobs(&host.AddJobsReq{HostJobs: hostJobs})
+	if err != nil {
+		return nil, placements, err
+	}
+	for _, p := range placements {
+		if e := checkScheduled(res, p.HostID, p.Job.ID); e != nil {
+			l.Log(grohl.Data{"at": "schedule", "host_id": p.HostID, "job_id": p.Job.ID, "error": e})
+			failed = append(failed, p)
+			err = e
+			continue
+		}
+		ok = append(ok, p)
+	}
+	return ok, failed, err
+}
+
+// retryableScheduleError reports whether a failure to schedule jobs may have
+// been caused by a host that was briefly unreachable.
+func retryableScheduleError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	switch err.(type) {
+	case *ScheduleError, net.Error:
+		return true
+	}
+	return false
+}
+
+func scheduleFailure(err error) error {
+	if _, ok := err.(*ScheduleError); ok {
+		return err
+	}
+	return upstreamFailure("", "schedule", err)
+}
+
+// UnreachableError is returned when the connection to the cluster leader, or
+// to a host if HostID is set, fails part way through a request.
+type UnreachableError struct {
+	HostID string
+	Op     string
+	Err    error
+}
+
+func (e *UnreachableError) Error() string {
+	if e.HostID == "" {
+		return fmt.Sprintf("%s failed: %s", e.Op, e.Err)
+	}
+	return fmt.Sprintf("%s failed: host %s: %s", e.Op, e.HostID, e.Err)
+}
+
+// upstreamFailure describes an error from the cluster or a host so that a
+// failed connection is told apart from the request itself failing. Errors
+// that already have a status of their own are returned as they are.
+func upstreamFailure(hostID, op string, err error) error {
+	if hostConnError(err) {
+		return &UnreachableError{HostID: hostID, Op: op, Err: err}
+	}
+	if _, ok := err.(*HostTimeoutError); ok || err == cluster.ErrWouldWait {
+		return err
+	}
+	return fmt.Errorf("%s failed: %s", op, err)
+}
+
+// checkScheduled verifies that the cluster state returned by AddJobs contains
+// the job on the requested host.
+func checkScheduled(res *host.AddJobsRes, hostID, jobID string) error {
+	if res == nil {
+		return nil
+	}
+	h, ok := res.State[hostID]
+	if !ok {
+		return &ScheduleError{HostID: hostID, JobID: jobID, Reason: "the host is not in the cluster"}
+	}
+	for _, j := range h.Jobs {
+		if j.ID == jobID {
+			return nil
+		}
+	}
+	return &ScheduleError{HostID: hostID, JobID: jobID, Reason: "the host did not accept the job"}
+}
+
+// bridgeAttach copies data in both directions between a client connection and
+// a job attach stream, returning once both directions are finished. If the
+// client goes away, which is noticed when reading from or writing to it fails,
+// both connections are closed so that neither copy is left blocked, and true
+// is returned. The number of bytes copied each way is returned too.
+func bridgeAttach(conn, attachConn cluster.ReadWriteCloser) (bool, attachCounts) {
+	var counts attachCounts
+	var once sync.Once
+	disconnected := false
+	disconnect := func() {
+		once.Do(func() {
+			disconnected = true
+			conn.Close()
+			attachConn.Close()
+		})
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		w := &errWriter{Writer: conn}
+		counts.stdout, _ = io.Copy(w, attachConn)
+		if w.err != nil {
+			disconnect()
+		} else {
+			conn.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		r := &errReader{Reader: conn}
+		counts.stdin, _ = io.Copy(attachConn, r)
+		if r.err != nil && r.err != io.EOF {
+			disconnect()
+		} else {
+			attachConn.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+	return disconnected, counts
+}
+
+// readOnlyAttach discards the client's input to a job that has a read-only
+// TTY, so that only the output is bridged.
+type readOnlyAttach struct {
+	cluster.ReadWriteCloser
+}
+
+func (readOnlyAttach) Write(p []byte) (int, error) { return len(p), nil }
+func (readOnlyAttach) CloseWrite() error           { return nil }
+
+// attachCounts is how many bytes were sent to the job and received from it
+// during an attach session.
+type attachCounts struct {
+	stdin, stdout int64
+}
+
+// errWriter and errReader record the first error from the wrapped stream, so
+// that the side of a copy that failed can be told apart.
+type errWriter struct {
+	io.Writer
+	err error
+}
+
+func (w *errWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+type errReader struct {
+	io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// serveAttach switches the client connection to the attach protocol, or to a
+// WebSocket if one was requested, and bridges it to attachConn until both
+// directions are finished. It reports whether the client disconnected early.
+// If the controller shuts down the client is sent EOF and the job stream is
+// closed.
+func serveAttach(l *grohl.Context, sessions *sessionRegistry, clk clock, w http.ResponseWriter, req *http.Request, attachConn cluster.ReadWriteCloser, r ResponseHelper) bool {
+	bridge := func(conn cluster.ReadWriteCloser) bool {
+		defer sessions.add(func() {
+			conn.CloseWrite()
+			attachConn.Close()
+		})()
+		start := clk.Now()
+		disconnected, counts := bridgeAttach(conn, attachConn)
+		l.Log(grohl.Data{"at": "attach_done", "stdin_bytes": counts.stdin, "stdout_bytes": counts.stdout, "duration": clk.Now().Sub(start).String()})
+		return disconnected
+	}
+
+	if isWebSocketUpgrade(req) {
+		conn, err := upgradeWebSocket(w, req)
+		if err != nil {
+			r.Error(fmt.Errorf("websocket upgrade failed: %s", err.Error()))
+			return false
+		}
+		defer conn.Close()
+		return bridge(conn)
+	}
+
+	// hijack before switching protocols so that a failure can still be
+	// reported to the client
+	conn, bufrw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		r.Error(fmt.Errorf("attach hijack failed: %s", err.Error()))
+		return false
+	}
+	defer conn.Close()
+	rwc, ok := conn.(cluster.ReadWriteCloser)
+	if !ok {
+		l.Log(grohl.Data{"at": "attach", "error": fmt.Sprintf("%T does not support half-close", conn)})
+		bufrw.WriteString("HTTP/1.1 500 Internal Server Error\r\nContent-Length: 0\r\n\r\n")
+		bufrw.Flush()
+		return false
+	}
+	bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\nContent-Type: application/vnd.flynn.attach\r\nContent-Length: 0\r\n\r\n")
+	if err := bufrw.Flush(); err != nil {
+		l.Log(grohl.Data{"at": "attach", "error": err})
+		return true
+	}
+	return bridge(rwc)
+}
+
+func attachJob(app *ct.App, params martini.Params, client cluster.Host, attach ct.JobAttach, hostConf *hostConfig, sessions *sessionRegistry, limiter *streamLimiter, clk clock, l *grohl.Context, req *http.Request, w http.ResponseWriter, r ResponseHelper) {
+	var errs ct.ValidationErrors
+	if attach.Columns < 0 {
+		errs = append(errs, ct.ValidationError{Field: "tty_columns", Message: "must not be negative"})
+	}
+	if attach.Lines < 0 {
+		errs = append(errs, ct.ValidationError{Field: "tty_lines", Message: "must not be negative"})
+	}
+	if len(errs) > 0 {
+		r.Error(errs)
+		return
+	}
+	if isWebSocketUpgrade(req) {
+		if err := validateWebSocketRequest(req); err != nil {
+			r.Error(err)
+			return
+		}
+	}
+	if _, ok := w.(http.Hijacker); !ok {
+		r.Error(errors.New("attach failed: connection does not support hijacking"))
+		return
+	}
+
+	jobID := params["jobs_id"]
+	job, err := client.GetJob(jobID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	if job == nil || job.Job == nil || job.Job.Attributes["flynn-controller.app"] != app.ID {
+		r.Error(ErrNotFound)
+		return
+	}
+
+	l = l.New(grohl.Data{"op": "attach_job", "app_id": app.ID, "host_id": params["hosts_id"], "job_id": jobID})
+	if err := limiter.acquire(); err != nil {
+		r.Error(err)
+		return
+	}
+	defer limiter.release()
+	attachReq := &host.AttachReq{
+		JobID:  jobID,
+		Flags:  host.AttachFlagStdout | host.AttachFlagStderr | host.AttachFlagStdin | host.AttachFlagStream,
+		Height: attach.Lines,
+		Width:  attach.Columns,
+	}
+	if job.Job.Config != nil && job.Job.Config.Tty {
+		attachReq.Height, attachReq.Width = ttySize(attach.Lines, attach.Columns)
+	}
+	attachConn, _, err := attachHost(client, params["hosts_id"], attachReq, false, hostConf)
+	if err != nil {
+		r.Error(attachError(client, jobID, err))
+		return
+	}
+	defer attachConn.Close()
+
+	l.Log(grohl.Data{"at": "attach"})
+	serveAttach(l, sessions, clk, w, req, attachConn, r)
 }
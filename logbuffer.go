@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// defaultLogBufferSize is how much log output is held for a slow client
+// before output is dropped.
+const defaultLogBufferSize = 1 << 20
+
+// logBuffer sits between a host's log stream and a client. Writes are queued
+// and sent to the client in the background, so a client that can't keep up
+// doesn't hold up the reads from the host. Output that doesn't fit in the
+// buffer is dropped and lag is called with the number of bytes that were
+// dropped before the output that follows them is sent.
+type logBuffer struct {
+	max int
+	lag func(dropped int64) error
+
+	mtx    sync.Mutex
+	cond   *sync.Cond
+	queue  []logBufferChunk
+	size   int
+	busy   bool
+	closed bool
+	err    error
+	done   chan struct{}
+}
+
+// logBufferChunk is either output for w or, if w is nil, a count of dropped
+// bytes.
+type logBufferChunk struct {
+	w       io.Writer
+	p       []byte
+	dropped int64
+}
+
+func newLogBuffer(max int, lag func(dropped int64) error) *logBuffer {
+	if max <= 0 {
+		max = defaultLogBufferSize
+	}
+	b := &logBuffer{max: max, lag: lag, done: make(chan struct{})}
+	b.cond = sync.NewCond(&b.mtx)
+	go b.drain()
+	return b
+}
+
+// Writer returns a writer that queues output for w.
+func (b *logBuffer) Writer(w io.Writer) io.Writer {
+	return logBufferWriter{b: b, w: w}
+}
+
+type logBufferWriter struct {
+	b *logBuffer
+	w io.Writer
+}
+
+func (w logBufferWriter) Write(p []byte) (int, error) {
+	return w.b.write(w.w, p)
+}
+
+func (b *logBuffer) write(w io.Writer, p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if b.size+len(p) > b.max {
+		if n := len(b.queue); n > 0 && b.queue[n-1].w == nil {
+			b.queue[n-1].dropped += int64(len(p))
+		} else {
+			b.queue = append(b.queue, logBufferChunk{dropped: int64(len(p))})
+		}
+	} else {
+		b.queue = append(b.queue, logBufferChunk{w: w, p: append([]byte(nil), p...)})
+		b.size += len(p)
+	}
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+func (b *logBuffer) drain() {
+	defer close(b.done)
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for {
+		for len(b.queue) == 0 && !b.closed {
+			b.cond.Wait()
+		}
+		if len(b.queue) == 0 {
+			return
+		}
+		chunk := b.queue[0]
+		b.queue = b.queue[1:]
+		b.busy = true
+		b.mtx.Unlock()
+		var err error
+		if chunk.w == nil {
+			err = b.lag(chunk.dropped)
+		} else {
+			_, err = chunk.w.Write(chunk.p)
+		}
+		b.mtx.Lock()
+		b.busy = false
+		b.size -= len(chunk.p)
+		if err != nil {
+			// the client has gone, so there's no point sending the rest
+			b.err = err
+			b.queue = nil
+			b.size = 0
+		}
+		b.cond.Broadcast()
+	}
+}
+
+// Flush waits until the queued output has been sent.
+func (b *logBuffer) Flush() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for (len(b.queue) > 0 || b.busy) && b.err == nil {
+		b.cond.Wait()
+	}
+	return b.err
+}
+
+// Close sends the queued output and stops the buffer.
+func (b *logBuffer) Close() error {
+	b.mtx.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mtx.Unlock()
+	<-b.done
+	return b.err
+}
+
+// bufferedSSELogWriter queues log chunks in a logBuffer. Events are sent
+// after the chunks that come before them.
+type bufferedSSELogWriter struct {
+	SSELogWriter
+	buf *logBuffer
+}
+
+func (w bufferedSSELogWriter) Stream(s string) io.Writer {
+	return w.buf.Writer(w.SSELogWriter.Stream(s))
+}
+
+func (w bufferedSSELogWriter) JobStream(jobID, s string) io.Writer {
+	return w.buf.Writer(w.SSELogWriter.JobStream(jobID, s))
+}
+
+func (w bufferedSSELogWriter) Event(name string, data interface{}) error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	return w.SSELogWriter.Event(name, data)
+}
+
+// sseLogLag is the data of the lag event that replaces output which was
+// dropped because the client couldn't keep up.
+type sseLogLag struct {
+	Dropped int64 `json:"dropped"`
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	. "github.com/titanous/gocheck"
+)
+
+// blockingWriter holds up writes until unblock is closed.
+type blockingWriter struct {
+	bytes.Buffer
+	unblock chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return w.Buffer.Write(p)
+}
+
+func (S) TestLogBufferLag(c *C) {
+	out := &blockingWriter{unblock: make(chan struct{})}
+	buf := newLogBuffer(10, func(dropped int64) error {
+		fmt.Fprintf(&out.Buffer, "[lag %d]", dropped)
+		return nil
+	})
+	stdout := buf.Writer(out)
+
+	// the writes don't wait for the client, output past the limit is
+	// dropped
+	for _, s := range []string{"12345", "67890", "abc", "de", "f"} {
+		n, err := stdout.Write([]byte(s))
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, len(s))
+	}
+	close(out.unblock)
+	c.Assert(buf.Flush(), IsNil)
+	stdout.Write([]byte("ghi"))
+	c.Assert(buf.Close(), IsNil)
+	c.Assert(out.String(), Equals, "1234567890[lag 6]ghi")
+}
+
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func (S) TestLogBufferWriteError(c *C) {
+	gone := errors.New("gone")
+	buf := newLogBuffer(10, nil)
+	w := buf.Writer(failingWriter{gone})
+	w.Write([]byte("foo"))
+	c.Assert(buf.Flush(), Equals, gone)
+	_, err := w.Write([]byte("bar"))
+	c.Assert(err, Equals, gone)
+	c.Assert(buf.Close(), Equals, gone)
+}
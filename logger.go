@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/technoweenie/grohl"
+)
+
+// newLogger returns the grohl.Logger for the given LOG_FORMAT. JSON is the
+// default, text writes grohl's key=value lines for local development.
+func newLogger(format string, w io.Writer) (grohl.Logger, error) {
+	switch format {
+	case "", "json":
+		return &jsonLogger{enc: json.NewEncoder(w)}, nil
+	case "text":
+		return grohl.NewIoLogger(w), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// jsonLogger writes each log line as a JSON object.
+type jsonLogger struct {
+	mtx sync.Mutex
+	enc *json.Encoder
+}
+
+func (l *jsonLogger) Log(data grohl.Data) error {
+	line := make(map[string]interface{}, len(data)+1)
+	for k, v := range data {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		line[k] = v
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.enc.Encode(line)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn-controller/utils"
+	"github.com/flynn/flynn-host/types"
+	"github.com/flynn/go-flynn/cluster"
+	"github.com/flynn/go-flynn/demultiplex"
+	"github.com/technoweenie/grohl"
+)
+
+const (
+	logStreamStdout byte = 1
+	logStreamStderr byte = 2
+)
+
+// multiplexWriter frames writes in the same format as the host attach stream
+// so that they can be read back with demultiplex.Copy.
+type multiplexWriter struct {
+	w      io.Writer
+	stream byte
+}
+
+func (m multiplexWriter) Write(p []byte) (int, error) {
+	header := make([]byte, 8)
+	header[0] = m.stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(p)))
+	if _, err := m.w.Write(header); err != nil {
+		return 0, err
+	}
+	return m.w.Write(p)
+}
+
+// tailBuffer retains the last n lines written to its streams, or all of them
+// if n is negative. If maxBytes is set, older lines are also dropped to keep
+// the retained lines within it.
+type tailBuffer struct {
+	n        int
+	maxBytes int64
+	lines    []logLine
+	size     int64
+	dropped  bool
+	partial  map[byte][]byte
+}
+
+type logLine struct {
+	stream byte
+	data   []byte
+}
+
+func newTailBuffer(n int) *tailBuffer {
+	return &tailBuffer{n: n, partial: make(map[byte][]byte)}
+}
+
+func (b *tailBuffer) Stream(stream byte) io.Writer {
+	return &tailStreamWriter{b: b, stream: stream}
+}
+
+func (b *tailBuffer) add(l logLine) {
+	b.lines = append(b.lines, l)
+	b.size += int64(len(l.data))
+	if b.n >= 0 && len(b.lines) > b.n {
+		b.shift()
+	}
+	for b.maxBytes > 0 && b.size > b.maxBytes {
+		b.shift()
+		b.dropped = true
+	}
+}
+
+func (b *tailBuffer) shift() {
+	b.size -= int64(len(b.lines[0].data))
+	b.lines = b.lines[1:]
+}
+
+// Truncated reports whether lines were dropped to stay within maxBytes.
+func (b *tailBuffer) Truncated() bool {
+	return b.dropped
+}
+
+func (b *tailBuffer) flush() {
+	for _, s := range []byte{logStreamStdout, logStreamStderr} {
+		if p := b.partial[s]; len(p) > 0 {
+			b.add(logLine{s, p})
+		}
+		delete(b.partial, s)
+	}
+}
+
+// Multiplexed returns the retained lines framed like a host attach stream.
+func (b *tailBuffer) Multiplexed() io.Reader {
+	b.flush()
+	var buf bytes.Buffer
+	for _, l := range b.lines {
+		multiplexWriter{&buf, l.stream}.Write(l.data)
+	}
+	return &buf
+}
+
+// Reversed is like Multiplexed, but returns the newest line first. A final
+// line without a newline is given one so that it isn't run into the next.
+func (b *tailBuffer) Reversed() io.Reader {
+	b.flush()
+	var buf bytes.Buffer
+	for i := len(b.lines) - 1; i >= 0; i-- {
+		l := b.lines[i]
+		if !bytes.HasSuffix(l.data, []byte("\n")) {
+			l.data = append(l.data, '\n')
+		}
+		multiplexWriter{&buf, l.stream}.Write(l.data)
+	}
+	return &buf
+}
+
+type tailStreamWriter struct {
+	b      *tailBuffer
+	stream byte
+}
+
+func (w *tailStreamWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.b.partial[w.stream] = append(w.b.partial[w.stream], p...)
+			break
+		}
+		line := append(w.b.partial[w.stream], p[:i+1]...)
+		delete(w.b.partial, w.stream)
+		w.b.add(logLine{w.stream, line})
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// timestampWriter prefixes each line written to it with the time that it was
+// received.
+type timestampWriter struct {
+	w       io.Writer
+	clk     clock
+	midLine bool
+}
+
+func (t *timestampWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	now := t.clk.Now().UTC().Format(time.RFC3339Nano)
+	var buf bytes.Buffer
+	for len(p) > 0 {
+		if !t.midLine {
+			buf.WriteString(now)
+			buf.WriteByte(' ')
+		}
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			buf.Write(p)
+			t.midLine = true
+			break
+		}
+		buf.Write(p[:i+1])
+		p = p[i+1:]
+		t.midLine = false
+	}
+	if _, err := t.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// logAggregator copies the logs of all of an app's jobs, or only those of a
+// process type if typ is set, to a single SSE stream. Jobs that can't be
+// attached to or whose streams end are dropped without affecting the others.
+type logAggregator struct {
+	log   *grohl.Context
+	cc    clusterClient
+	w     SSELogWriter
+	appID string
+	typ   string
+	flags host.AttachFlag
+
+	mtx    sync.Mutex
+	seen   map[string]struct{}
+	active map[string]io.Closer
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newLogAggregator(l *grohl.Context, cc clusterClient, w SSELogWriter, appID, typ string, flags host.AttachFlag) *logAggregator {
+	return &logAggregator{
+		log:    l,
+		cc:     cc,
+		w:      w,
+		appID:  appID,
+		typ:    typ,
+		flags:  flags,
+		seen:   make(map[string]struct{}),
+		active: make(map[string]io.Closer),
+	}
+}
+
+// attach starts copying the logs of any of the app's jobs on hosts that are
+// not already being copied. Each job is only attached to once.
+func (a *logAggregator) attach(hosts map[string]host.Host) {
+	for _, h := range hosts {
+		for _, j := range h.Jobs {
+			if j.Attributes["flynn-controller.app"] != a.appID {
+				continue
+			}
+			if a.typ != "" && j.Attributes["flynn-controller.type"] != a.typ {
+				continue
+			}
+			id := utils.FormatJobID(h.ID, j.ID)
+			if _, ok := a.seen[id]; ok {
+				continue
+			}
+			a.seen[id] = struct{}{}
+			a.attachJob(h.ID, j.ID)
+		}
+	}
+}
+
+func (a *logAggregator) attachJob(hostID, jobID string) {
+	id := utils.FormatJobID(hostID, jobID)
+	client, err := a.cc.DialHost(hostID)
+	if err != nil {
+		a.log.Log(grohl.Data{"at": "connect_host", "host_id": hostID, "job_id": id, "error": err})
+		return
+	}
+	logs, _, err := client.Attach(&host.AttachReq{JobID: jobID, Flags: a.flags}, false)
+	if err != nil {
+		a.log.Log(grohl.Data{"at": "attach", "host_id": hostID, "job_id": id, "error": err})
+		client.Close()
+		return
+	}
+
+	a.mtx.Lock()
+	if a.closed {
+		a.mtx.Unlock()
+		logs.Close()
+		client.Close()
+		return
+	}
+	a.active[id] = logs
+	a.mtx.Unlock()
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		a.copy(id, client, logs)
+	}()
+}
+
+func (a *logAggregator) copy(id string, client cluster.Host, logs cluster.ReadWriteCloser) {
+	demultiplex.Copy(a.w.JobStream(id, "stdout"), a.w.JobStream(id, "stderr"), logs)
+	logs.Close()
+	client.Close()
+	a.mtx.Lock()
+	delete(a.active, id)
+	a.mtx.Unlock()
+}
+
+// Close stops all of the copies that are in progress.
+func (a *logAggregator) Close() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.closed = true
+	for _, logs := range a.active {
+		logs.Close()
+	}
+	return nil
+}
+
+// Wait blocks until all of the copies have finished.
+func (a *logAggregator) Wait() {
+	a.wg.Wait()
+}
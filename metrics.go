@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/go-flynn/cluster"
+)
+
+// This is a minimal implementation of the Prometheus text exposition format,
+// just enough to expose job metrics without pulling in a client library.
+
+var (
+	runJobTotal = newCounterVec("controller_run_job_total",
+		"One-off jobs run, by attach mode and result.", "mode", "result")
+	killJobTotal = newCounterVec("controller_kill_job_total",
+		"Requests to kill a job, by result.", "result")
+	jobLogAttachDuration = newHistogram("controller_job_log_attach_duration_seconds",
+		"Time taken to attach to a job's log.", []float64{.005, .01, .05, .1, .5, 1, 5})
+	openLogStreams = newGauge("controller_log_streams",
+		"Log streams that are currently open.")
+	openStreams = newGauge("controller_streams",
+		"Log and attach streams that are currently open.")
+	maxStreams = newGauge("controller_streams_max",
+		"The most log and attach streams that can be open at once, 0 if there is no limit.")
+
+	allMetrics = []metric{runJobTotal, killJobTotal, jobLogAttachDuration, openLogStreams, openStreams, maxStreams}
+)
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+func serveMetrics(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range allMetrics {
+		m.writeTo(w)
+	}
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mtx    sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// Inc increments the counter with the given label values, which must be in
+// the same order as the label names.
+func (c *counterVec) Inc(values ...string) {
+	key := strings.Join(values, "\xff")
+	c.mtx.Lock()
+	c.values[key]++
+	c.mtx.Unlock()
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		pairs := make([]string, len(c.labels))
+		for i, v := range strings.Split(k, "\xff") {
+			pairs[i] = fmt.Sprintf("%s=%q", c.labels[i], v)
+		}
+		fmt.Fprintf(w, "%s{%s} %s\n", c.name, strings.Join(pairs, ","), formatFloat(c.values[k]))
+	}
+}
+
+type gauge struct {
+	name, help string
+
+	mtx   sync.Mutex
+	value float64
+}
+
+func newGauge(name, help string) *gauge {
+	return &gauge{name: name, help: help}
+}
+
+func (g *gauge) Add(delta float64) {
+	g.mtx.Lock()
+	g.value += delta
+	g.mtx.Unlock()
+}
+
+func (g *gauge) Set(v float64) {
+	g.mtx.Lock()
+	g.value = v
+	g.mtx.Unlock()
+}
+
+func (g *gauge) Inc() { g.Add(1) }
+func (g *gauge) Dec() { g.Add(-1) }
+
+func (g *gauge) writeTo(w io.Writer) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.value))
+}
+
+type histogram struct {
+	name, help string
+	buckets    []float64
+
+	mtx    sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Since observes the number of seconds since start.
+func (h *histogram) Since(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", h.name, formatFloat(h.sum), h.name, h.count)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// resultRecorder wraps a ResponseHelper to remember the error that a handler
+// responded with, so that the result of the request can be counted.
+type resultRecorder struct {
+	ResponseHelper
+	err error
+}
+
+func (r *resultRecorder) Error(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.ResponseHelper.Error(err)
+}
+
+// result returns the metric label for the outcome of the request.
+func (r *resultRecorder) result() string {
+	switch err := r.err.(type) {
+	case nil:
+		return "success"
+	case ct.ValidationError, ct.ValidationErrors, *NotAcceptableError:
+		return "invalid"
+	case *HostDialError, *UnreachableError:
+		return "host_unreachable"
+	case *HostTimeoutError:
+		return "host_timeout"
+	case *ScheduleError:
+		return "not_scheduled"
+	case *JobLimitError, *StreamLimitError:
+		return "limited"
+	default:
+		switch err {
+		case ErrNotFound:
+			return "not_found"
+		case ErrNoHosts:
+			return "no_hosts"
+		case cluster.ErrWouldWait:
+			return "would_wait"
+		}
+		return "error"
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-controller/utils"
+	"github.com/flynn/flynn-host/types"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) TestMetricsFormat(c *C) {
+	var buf bytes.Buffer
+	counter := newCounterVec("test_total", "Test counter.", "a", "b")
+	counter.Inc("x", "y")
+	counter.Inc("x", "y")
+	counter.Inc("x", "z")
+	counter.writeTo(&buf)
+	c.Assert(buf.String(), Equals, `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{a="x",b="y"} 2
+test_total{a="x",b="z"} 1
+`)
+
+	buf.Reset()
+	h := newHistogram("test_seconds", "Test histogram.", []float64{.1, 1})
+	h.Observe(.05)
+	h.Observe(.5)
+	h.Observe(2)
+	h.writeTo(&buf)
+	c.Assert(buf.String(), Equals, `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 2.55
+test_seconds_count 3
+`)
+
+	buf.Reset()
+	g := newGauge("test_open", "Test gauge.")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	g.writeTo(&buf)
+	c.Assert(buf.String(), Equals, "# HELP test_open Test gauge.\n# TYPE test_open gauge\ntest_open 1\n")
+}
+
+func (s *S) TestMetrics(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "metrics"})
+	hostID := utils.UUID()
+	s.cc.setHosts(map[string]host.Host{hostID: {ID: hostID}})
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://foo/bar"})
+	release := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+
+	_, err := s.Post(fmt.Sprintf("/apps/%s/jobs", app.ID), &ct.NewJob{ReleaseID: release.ID, Cmd: []string{"true"}}, &ct.Job{})
+	c.Assert(err, IsNil)
+	_, err = s.Post(fmt.Sprintf("/apps/%s/jobs", app.ID), &ct.NewJob{ReleaseID: release.ID}, nil)
+	c.Assert(err, IsNil)
+
+	req, err := http.NewRequest("GET", s.srv.URL+"/metrics", nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("Content-Type"), Equals, "text/plain; version=0.0.4")
+	body, err := s.body(res)
+	c.Assert(err, IsNil)
+	for _, line := range []string{
+		`controller_run_job_total{mode="detached",result="success"}`,
+		`controller_run_job_total{mode="detached",result="invalid"}`,
+		"# TYPE controller_job_log_attach_duration_seconds histogram",
+		"controller_log_streams 0",
+	} {
+		c.Assert(strings.Contains(body, line), Equals, true, Commentf("missing %s", line))
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+)
+
+type object map[string]interface{}
+
+// openAPIDoc describes the job endpoints. The body schemas are generated
+// from the types in ct so that they stay in sync with the API.
+var openAPIDoc = newOpenAPIDoc()
+
+func serveOpenAPI(r ResponseHelper) {
+	r.JSON(200, openAPIDoc)
+}
+
+func newOpenAPIDoc() object {
+	schemas := object{
+		"NewJob":      jsonSchema(reflect.TypeOf(ct.NewJob{})),
+		"NewImageJob": jsonSchema(reflect.TypeOf(ct.NewImageJob{})),
+		"Job":         jsonSchema(reflect.TypeOf(ct.Job{})),
+		"JobRelease":  jsonSchema(reflect.TypeOf(ct.JobRelease{})),
+		"Error":       jsonSchema(reflect.TypeOf(ct.Error{})),
+	}
+
+	appID := pathParam("app_id", "The app ID or name.")
+	jobID := pathParam("job_id", "The job ID, in the form <host_id>-<job_id>.")
+	// with adds the responses that all of the endpoints share
+	with := func(responses object) object {
+		responses["400"] = response("The request is invalid.", schemaRef("Error"))
+		responses["404"] = response("The app or job does not exist.", schemaRef("Error"))
+		return responses
+	}
+
+	paths := object{
+		"/apps/{app_id}/jobs": object{
+			"get": object{
+				"summary": "List an app's jobs",
+				"parameters": []object{
+					appID,
+					queryParam("limit", "integer", "The number of jobs to return, 100 by default or every job for text/csv."),
+					queryParam("offset", "integer", "The number of jobs to skip."),
+					queryParam("sort", "string", "Set to created_at to sort from oldest to newest."),
+					queryParam("type", "string", "Only return jobs of this process type."),
+					queryParam("release", "string", "Only return jobs of this release."),
+					queryParam("kind", "string", "Set to oneoff or service to only return one-off jobs or jobs with a process type."),
+				},
+				"responses": with(object{
+					"200": object{
+						"description": "The jobs.",
+						"headers": object{
+							"X-Total-Count": object{"schema": object{"type": "integer"}, "description": "The number of jobs before paging."},
+						},
+						"content": object{
+							"application/json": object{"schema": object{"type": "array", "items": schemaRef("Job")}},
+							// one row per job after a header row
+							"text/csv": object{"schema": object{"type": "string"}},
+						},
+					},
+				}),
+			},
+			"post": object{
+				"summary": "Run a one-off job",
+				"parameters": []object{
+					appID,
+					queryParam("dry_run", "boolean", "Return where the jobs would be placed without running them."),
+					queryParam("kill_on_disconnect", "boolean", "Stop an attached job when the client goes away."),
+					{"name": "Idempotency-Key", "in": "header", "schema": object{"type": "string"}, "description": "Return the result of an earlier request with the same key instead of running the job again."},
+				},
+				"requestBody": object{
+					"required": true,
+					"content":  responseContent(schemaRef("NewJob"), "application/json"),
+				},
+				"responses": with(object{
+					"200": object{
+						"description": "The job, or a list of jobs if count is more than 1. With an Accept of application/vnd.flynn.attach the connection is hijacked and attached to the job. If stdin is set without attaching, the rest of the request body after the job is sent to the job's stdin and its output is returned. With an Accept of text/event-stream, job events are sent as the jobs are pulled and started.",
+						"content": object{
+							"application/json":             object{"schema": object{"oneOf": []object{schemaRef("Job"), {"type": "array", "items": schemaRef("Job")}}}},
+							"application/vnd.flynn.attach": object{},
+							"application/octet-stream":     object{},
+							"text/event-stream":            object{},
+						},
+					},
+					"406": response("None of the accepted media types are supported.", schemaRef("Error")),
+					"413": response("The job is larger than 1MB.", schemaRef("Error")),
+					"422": response("The job is invalid.", schemaRef("Error")),
+					"429": response("The app is running too many one-off jobs.", schemaRef("Error")),
+					"502": response("The cluster or the job's host could not be reached.", schemaRef("Error")),
+					"503": response("There are no hosts to run the job on, or the job was not scheduled.", schemaRef("Error")),
+					"504": response("The job's host did not respond in time.", schemaRef("Error")),
+				}),
+			},
+		},
+		"/apps/{app_id}/runimage": object{
+			"post": object{
+				"summary": "Run a one-off job from an artifact URI instead of a release",
+				"parameters": []object{
+					appID,
+					queryParam("dry_run", "boolean", "Return where the jobs would be placed without running them."),
+					queryParam("kill_on_disconnect", "boolean", "Stop an attached job when the client goes away."),
+				},
+				"requestBody": object{
+					"required": true,
+					"content":  responseContent(schemaRef("NewImageJob"), "application/json"),
+				},
+				"responses": with(object{
+					"200": object{
+						"description": "The job, as for POST /apps/{app_id}/jobs.",
+						"content": object{
+							"application/json":             object{"schema": object{"oneOf": []object{schemaRef("Job"), {"type": "array", "items": schemaRef("Job")}}}},
+							"application/vnd.flynn.attach": object{},
+						},
+					},
+					"413": response("The job is larger than 1MB.", schemaRef("Error")),
+					"422": response("The job or its artifact URI is invalid, or a release was given.", schemaRef("Error")),
+					"502": response("The cluster or the job's host could not be reached.", schemaRef("Error")),
+					"503": response("There are no hosts to run the job on, or the job was not scheduled.", schemaRef("Error")),
+				}),
+			},
+		},
+		"/jobs": object{
+			"get": object{
+				"summary": "Search the jobs of every app",
+				"parameters": []object{
+					queryParam("attr.<key>", "string", "Only return jobs whose attribute <key> has this value, such as attr.flynn-controller.release=<release_id>. At least one is required and they all have to match."),
+				},
+				"responses": object{
+					"200": object{"description": "The matching jobs, including their app IDs.", "content": responseContent(object{"type": "array", "items": schemaRef("Job")}, "application/json")},
+					"400": response("No attributes were given.", schemaRef("Error")),
+				},
+			},
+		},
+		"/apps/{app_id}/jobs/{job_id}": object{
+			"get": object{
+				"summary":    "Get a job",
+				"parameters": []object{appID, jobID},
+				"responses":  with(object{"200": object{"description": "The job. Detached one-off jobs that have exited are still returned, with their exit code, for a while after their host removes them.", "content": responseContent(schemaRef("Job"), "application/json")}}),
+			},
+			"delete": object{
+				"summary":    "Stop a job",
+				"parameters": []object{appID, jobID},
+				"responses":  with(object{"204": object{"description": "The job was stopped."}}),
+			},
+		},
+		"/apps/{app_id}/jobs/{job_id}/release": object{
+			"get": object{
+				"summary":    "Get the release and artifact that a job was run from",
+				"parameters": []object{appID, jobID},
+				"responses":  with(object{"200": object{"description": "The release and its artifact.", "content": responseContent(schemaRef("JobRelease"), "application/json")}}),
+			},
+		},
+		"/apps/{app_id}/jobs/{job_id}/log": object{
+			"get": object{
+				"summary": "Get a job's log",
+				"parameters": []object{
+					appID, jobID,
+					queryParam("stream", "boolean", "Keep the response open while the job is running."),
+					queryParam("follow", "boolean", "Keep the response open and follow the job across restarts."),
+					queryParam("tail", "integer", "Only return the last lines of the log, cannot be used with stream or follow."),
+					queryParam("max_bytes", "integer", "Stop after this many bytes of log data."),
+					queryParam("streams", "string", "stdout, stderr or both, comma separated."),
+					queryParam("timestamps", "boolean", "Prefix each line with the time it was written."),
+					queryParam("merge", "boolean", "Interleave stdout and stderr in the order they were written, labelled as the combined stream. Raw output is sent without framing."),
+					queryParam("order", "string", "asc, the default, or desc for newest lines first."),
+					queryParam("grep", "string", "Only return lines that match this regular expression."),
+					{"name": "Last-Event-ID", "in": "header", "schema": object{"type": "integer"}, "description": "Resume an event stream after the chunk with this ID."},
+				},
+				"responses": with(object{
+					"200": object{
+						"description": "The log, as multiplexed stdout and stderr frames, newline delimited JSON or server-sent events.",
+						"content":     logContent(),
+					},
+					"406": response("None of the accepted media types are supported.", schemaRef("Error")),
+					"504": response("The job's host did not respond in time.", schemaRef("Error")),
+				}),
+			},
+		},
+		"/apps/{app_id}/types/{type}/log": object{
+			"get": object{
+				"summary": "Get the logs of all of the jobs of a process type",
+				"parameters": []object{
+					appID, pathParam("type", "The process type, such as web."),
+					queryParam("stream", "boolean", "Keep the response open, jobs of the type that start later are added to the stream."),
+					queryParam("timestamps", "boolean", "Include the time each chunk was received."),
+				},
+				"responses": with(object{
+					"200": object{
+						"description": "Server-sent events with the chunks of each job's log, tagged with the job ID.",
+						"content":     object{"text/event-stream": object{}},
+					},
+				}),
+			},
+		},
+	}
+
+	return object{
+		"openapi": "3.0.0",
+		"info": object{
+			"title":   "Flynn controller job API",
+			"version": "1",
+		},
+		"security": []object{{"basicAuth": []string{}}},
+		"paths":    paths,
+		"components": object{
+			"schemas":         schemas,
+			"securitySchemes": object{"basicAuth": object{"type": "http", "scheme": "basic"}},
+		},
+	}
+}
+
+func logContent() object {
+	content := make(object, len(jobLogMediaTypes))
+	for _, t := range jobLogMediaTypes {
+		content[t] = object{}
+	}
+	return content
+}
+
+func schemaRef(name string) object {
+	return object{"$ref": "#/components/schemas/" + name}
+}
+
+func pathParam(name, desc string) object {
+	return object{"name": name, "in": "path", "required": true, "schema": object{"type": "string"}, "description": desc}
+}
+
+func queryParam(name, typ, desc string) object {
+	return object{"name": name, "in": "query", "schema": object{"type": typ}, "description": desc}
+}
+
+func response(desc string, schema object) object {
+	return object{"description": desc, "content": responseContent(schema, "application/json")}
+}
+
+func responseContent(schema object, types ...string) object {
+	content := make(object, len(types))
+	for _, t := range types {
+		content[t] = object{"schema": schema}
+	}
+	return content
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonSchema returns a JSON schema for values of t as encoded by
+// encoding/json.
+func jsonSchema(t reflect.Type) object {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return object{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return object{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return object{"type": "number"}
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return object{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return object{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		props := make(object, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" && f.Anonymous && f.Type.Kind() == reflect.Struct {
+				// encoding/json promotes the fields of embedded structs
+				for k, v := range jsonSchema(f.Type)["properties"].(object) {
+					props[k] = v
+				}
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = jsonSchema(f.Type)
+		}
+		return object{"type": "object", "properties": props}
+	}
+	return object{}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+
+	ct "github.com/flynn/flynn-controller/types"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) TestOpenAPI(c *C) {
+	var doc struct {
+		Paths      map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Type       string                            `json:"type"`
+				Properties map[string]map[string]interface{} `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	res, err := s.Get("/openapi.json", &doc)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	for path, methods := range map[string][]string{
+		"/apps/{app_id}/jobs":              {"get", "post"},
+		"/apps/{app_id}/jobs/{job_id}":     {"get", "delete"},
+		"/apps/{app_id}/jobs/{job_id}/log": {"get"},
+	} {
+		for _, m := range methods {
+			c.Assert(doc.Paths[path][m], NotNil, Commentf("%s %s", m, path))
+		}
+	}
+
+	// every field of the bodies is described
+	for name, v := range map[string]interface{}{"NewJob": ct.NewJob{}, "Job": ct.Job{}} {
+		schema := doc.Components.Schemas[name]
+		c.Assert(schema.Type, Equals, "object")
+		t := reflect.TypeOf(v)
+		c.Assert(schema.Properties, HasLen, t.NumField(), Commentf("schema = %s", name))
+		for i := 0; i < t.NumField(); i++ {
+			field := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			c.Assert(schema.Properties[field], NotNil, Commentf("schema = %s, field = %s", name, field))
+		}
+	}
+	job := doc.Components.Schemas["Job"].Properties
+	c.Assert(job["created_at"], DeepEquals, map[string]interface{}{"type": "string", "format": "date-time"})
+	c.Assert(job["env"], DeepEquals, map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "string"}})
+	c.Assert(doc.Components.Schemas["NewJob"].Properties["stdout"], DeepEquals, map[string]interface{}{"type": "boolean"})
+}
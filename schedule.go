@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/flynn/flynn-host/types"
+)
+
+// ErrNoHosts is returned when there are no hosts that a job can be scheduled
+// on.
+var ErrNoHosts = errors.New("no hosts available")
+
+// scheduler picks the host that a new job should be run on.
+type scheduler interface {
+	PickHost(hosts map[string]host.Host, job *host.Job) (string, error)
+}
+
+// schedulers are the scheduling strategies that can be chosen by name.
+var schedulers = map[string]scheduler{
+	"least-loaded": leastLoadedScheduler{},
+	"random":       randomScheduler{},
+}
+
+// parseScheduler returns the scheduler with the given name, or the least
+// loaded one if name is empty.
+func parseScheduler(name string) (scheduler, error) {
+	if name == "" {
+		return leastLoadedScheduler{}, nil
+	}
+	sched, ok := schedulers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown scheduler %q", name)
+	}
+	return sched, nil
+}
+
+// randomScheduler picks any of the hosts.
+type randomScheduler struct{}
+
+func (randomScheduler) PickHost(hosts map[string]host.Host, job *host.Job) (string, error) {
+	if len(hosts) == 0 {
+		return "", ErrNoHosts
+	}
+	ids := make([]string, 0, len(hosts))
+	for id := range hosts {
+		ids = append(ids, id)
+	}
+	return ids[rand.Intn(len(ids))], nil
+}
+
+// leastLoadedScheduler picks the host running the fewest jobs, breaking ties
+// by host ID so that placement is deterministic.
+type leastLoadedScheduler struct{}
+
+func (leastLoadedScheduler) PickHost(hosts map[string]host.Host, job *host.Job) (string, error) {
+	if len(hosts) == 0 {
+		return "", ErrNoHosts
+	}
+	sh := make(sortHosts, 0, len(hosts))
+	for id, h := range hosts {
+		sh = append(sh, sortHost{id, len(h.Jobs)})
+	}
+	sort.Sort(sh)
+	return sh[0].ID, nil
+}
+
+type sortHost struct {
+	ID   string
+	Jobs int
+}
+
+type sortHosts []sortHost
+
+func (h sortHosts) Len() int { return len(h) }
+func (h sortHosts) Less(i, j int) bool {
+	if h[i].Jobs == h[j].Jobs {
+		return h[i].ID < h[j].ID
+	}
+	return h[i].Jobs < h[j].Jobs
+}
+func (h sortHosts) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+// hostDrainAttr is the host attribute that operators set to "true" to stop
+// new jobs from being scheduled on a host, jobs already running on it are left
+// alone.
+const hostDrainAttr = "flynn-host.drain"
+
+func hostDraining(h host.Host) bool {
+	return h.Attributes[hostDrainAttr] == "true"
+}
+
+// schedulableHosts returns the hosts that are not being drained.
+func schedulableHosts(hosts map[string]host.Host) map[string]host.Host {
+	res := make(map[string]host.Host, len(hosts))
+	for id, h := range hosts {
+		if !hostDraining(h) {
+			res[id] = h
+		}
+	}
+	return res
+}
+
+// hostPorts returns the fixed ports that a job's host config binds on its
+// host, sorted and as port/protocol.
+func hostPorts(job *host.Job) []string {
+	if job.HostConfig == nil {
+		return nil
+	}
+	var ports []string
+	for spec, bindings := range job.HostConfig.PortBindings {
+		proto := "tcp"
+		if i := strings.Index(spec, "/"); i >= 0 {
+			proto = spec[i+1:]
+		}
+		for _, b := range bindings {
+			// no host port, or port 0, lets the host pick a free one
+			if b.HostPort != "" && b.HostPort != "0" {
+				ports = append(ports, b.HostPort+"/"+proto)
+			}
+		}
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// hostPortConflict returns a port that a job on the host already binds, or
+// "" if none of the ports are in use.
+func hostPortConflict(h host.Host, ports []string) string {
+	for _, j := range h.Jobs {
+		for _, used := range hostPorts(j) {
+			for _, p := range ports {
+				if p == used {
+					return p
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// freePortHosts returns the hosts that none of the ports are in use on.
+func freePortHosts(hosts map[string]host.Host, ports []string) map[string]host.Host {
+	if len(ports) == 0 {
+		return hosts
+	}
+	res := make(map[string]host.Host, len(hosts))
+	for id, h := range hosts {
+		if hostPortConflict(h, ports) == "" {
+			res[id] = h
+		}
+	}
+	return res
+}
+
+// matchHosts returns the hosts that have all of the given attributes.
+func matchHosts(hosts map[string]host.Host, constraints map[string]string) map[string]host.Host {
+	if len(constraints) == 0 {
+		return hosts
+	}
+	res := make(map[string]host.Host, len(hosts))
+outer:
+	for id, h := range hosts {
+		for k, v := range constraints {
+			if attr, ok := h.Attributes[k]; !ok || attr != v {
+				continue outer
+			}
+		}
+		res[id] = h
+	}
+	return res
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultShutdownGrace is how long the controller waits for open sessions to
+// finish after it has been asked to stop.
+const defaultShutdownGrace = 10 * time.Second
+
+// sessionRegistry tracks long lived requests, log streams and attach
+// sessions, so that they can be ended cleanly when the controller shuts down.
+type sessionRegistry struct {
+	mtx      sync.Mutex
+	stopping bool
+	sessions map[*session]struct{}
+	wg       sync.WaitGroup
+	clock    clock
+}
+
+type session struct {
+	once sync.Once
+	stop func()
+}
+
+func newSessionRegistry(clk clock) *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[*session]struct{}), clock: clk}
+}
+
+// add registers a session. stop is called when the controller shuts down and
+// must make the handler wrap up, the returned function must be called once
+// the session has ended. If the controller is already shutting down, stop is
+// called straight away.
+func (r *sessionRegistry) add(stop func()) func() {
+	s := &session{stop: stop}
+	r.mtx.Lock()
+	r.sessions[s] = struct{}{}
+	r.wg.Add(1)
+	stopping := r.stopping
+	r.mtx.Unlock()
+	if stopping {
+		s.once.Do(s.stop)
+	}
+
+	var done sync.Once
+	return func() {
+		done.Do(func() {
+			r.mtx.Lock()
+			delete(r.sessions, s)
+			r.mtx.Unlock()
+			r.wg.Done()
+		})
+	}
+}
+
+// shutdown stops all of the registered sessions and waits up to grace for
+// them to end. It reports whether they all did.
+func (r *sessionRegistry) shutdown(grace time.Duration) bool {
+	r.mtx.Lock()
+	r.stopping = true
+	sessions := make([]*session, 0, len(r.sessions))
+	for s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	r.mtx.Unlock()
+	for _, s := range sessions {
+		s.once.Do(s.stop)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-r.clock.After(grace):
+		return false
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-controller/utils"
+	"github.com/flynn/flynn-host/types"
+	"github.com/flynn/go-flynn/cluster"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) TestSessionRegistry(c *C) {
+	clk := newFakeClock()
+	reg := newSessionRegistry(clk)
+
+	stopped := make(chan struct{})
+	done := reg.add(func() { close(stopped) })
+	go func() {
+		<-stopped
+		done()
+	}()
+	hung := reg.add(func() {})
+	res := make(chan bool)
+	go func() { res <- reg.shutdown(time.Minute) }()
+	for i := 0; i < 100 && clk.Waiting() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	clk.Advance(time.Minute)
+	c.Assert(<-res, Equals, false)
+	hung()
+	c.Assert(reg.shutdown(time.Minute), Equals, true)
+
+	// sessions that start during shutdown are stopped straight away
+	var late bool
+	reg.add(func() { late = true })()
+	c.Assert(late, Equals, true)
+}
+
+// pipeLog is a job log stream that ends when it is closed.
+type pipeLog struct {
+	*io.PipeReader
+}
+
+func (l pipeLog) Write([]byte) (int, error) { return 0, io.ErrUnexpectedEOF }
+func (l pipeLog) CloseWrite() error         { return nil }
+
+func (s *S) TestJobLogShutdown(c *C) {
+	reg := newSessionRegistry(realClock{})
+	s.m.Map(reg)
+	defer s.m.Map(newSessionRegistry(realClock{}))
+
+	app := s.createTestApp(c, &ct.App{Name: "joblog-shutdown"})
+	hc := newFakeHostClient()
+	hostID, jobID := utils.UUID(), utils.UUID()
+	piper, pipew := io.Pipe()
+	defer pipew.Close()
+	hc.setAttachFunc(jobID, func(*host.AttachReq, bool) (cluster.ReadWriteCloser, func() error, error) {
+		return pipeLog{piper}, nil, nil
+	})
+	s.cc.setHostClient(hostID, hc)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/apps/%s/jobs/%s-%s/log?stream=true", s.srv.URL, app.ID, hostID, jobID), nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	go multiplexWriter{pipew, logStreamStdout}.Write([]byte("hello\n"))
+	br := bufio.NewReader(res.Body)
+	line, err := br.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, "id: 6\n")
+	line, err = br.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, "data: {\"stream\":\"stdout\",\"data\":\"hello\\n\"}\n")
+
+	c.Assert(reg.shutdown(time.Second), Equals, true)
+	rest, err := ioutil.ReadAll(br)
+	c.Assert(err, IsNil)
+	c.Assert(string(rest), Equals, "\nevent: eof\ndata: {}\n\n")
+}
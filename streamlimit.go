@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// streamLimitRetryAfter is how many seconds clients are told to wait when the
+// controller has too many open streams.
+const streamLimitRetryAfter = "5"
+
+// streamLimiter caps the number of log and attach streams that are open at
+// once. A max of zero means there is no cap.
+type streamLimiter struct {
+	max  int64
+	open int64
+}
+
+func newStreamLimiter(max int) *streamLimiter {
+	maxStreams.Set(float64(max))
+	return &streamLimiter{max: int64(max)}
+}
+
+// acquire reserves a stream, release must be called once it has ended. It
+// returns a *StreamLimitError if the cap has been reached.
+func (s *streamLimiter) acquire() error {
+	n := atomic.AddInt64(&s.open, 1)
+	if s.max > 0 && n > s.max {
+		atomic.AddInt64(&s.open, -1)
+		return &StreamLimitError{Limit: int(s.max)}
+	}
+	openStreams.Inc()
+	return nil
+}
+
+func (s *streamLimiter) release() {
+	atomic.AddInt64(&s.open, -1)
+	openStreams.Dec()
+}
+
+// StreamLimitError is returned when opening a stream would take the
+// controller over its cap.
+type StreamLimitError struct {
+	Limit int
+}
+
+func (e *StreamLimitError) Error() string {
+	return fmt.Sprintf("the controller has reached its limit of %d open streams", e.Limit)
+}
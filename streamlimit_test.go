@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-controller/utils"
+	. "github.com/titanous/gocheck"
+)
+
+func (s *S) TestStreamLimit(c *C) {
+	limiter := newStreamLimiter(1)
+	s.m.Map(limiter)
+	defer s.m.Map(newStreamLimiter(0))
+
+	app := s.createTestApp(c, &ct.App{Name: "stream-limit"})
+	hc := newFakeHostClient()
+	hostID, jobID := utils.UUID(), utils.UUID()
+	s.cc.setHostClient(hostID, hc)
+	path := fmt.Sprintf("/apps/%s/jobs/%s-%s/log", app.ID, hostID, jobID)
+
+	// the stream is released once the request is done
+	for i := 0; i < 2; i++ {
+		hc.setAttach(jobID, newFakeLog(strings.NewReader(logFrame(logStreamStdout, "hello\n"))))
+		res, _ := s.getJobLog(c, path, "")
+		c.Assert(res.StatusCode, Equals, 200)
+	}
+
+	c.Assert(limiter.acquire(), IsNil)
+	res, body := s.getJobLog(c, path, "text/event-stream")
+	c.Assert(res.StatusCode, Equals, 503)
+	c.Assert(res.Header.Get("Retry-After"), Equals, streamLimitRetryAfter)
+	c.Assert(body, Matches, `.*limit of 1 open streams.*`)
+
+	_, body = s.getJobLog(c, "/metrics", "")
+	c.Assert(body, Matches, `(?s).*\ncontroller_streams 1\n.*\ncontroller_streams_max 1\n.*`)
+	limiter.release()
+
+	unlimited := newStreamLimiter(0)
+	for i := 0; i < 10; i++ {
+		c.Assert(unlimited.acquire(), IsNil)
+		defer unlimited.release()
+	}
+}
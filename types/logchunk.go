@@ -0,0 +1,141 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// LogChunk is the Go type of the message in logchunk.proto. It is encoded by
+// hand rather than with a protobuf package, the encoding is the standard wire
+// format so any protobuf library can decode it.
+type LogChunk struct {
+	Stream    string
+	Timestamp int64
+	Data      []byte
+}
+
+// MaxLogChunkSize is the largest framed LogChunk that ReadLogChunk accepts.
+const MaxLogChunkSize = 16 << 20
+
+var errInvalidLogChunk = errors.New("types: invalid LogChunk")
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Marshal returns the protobuf encoding of c, fields with zero values are
+// left out.
+func (c *LogChunk) Marshal() []byte {
+	buf := make([]byte, 0, len(c.Stream)+len(c.Data)+3*binary.MaxVarintLen64)
+	if c.Stream != "" {
+		buf = appendBytesField(buf, 1, []byte(c.Stream))
+	}
+	if c.Timestamp != 0 {
+		buf = appendUvarint(buf, 2<<3|wireVarint)
+		buf = appendUvarint(buf, uint64(c.Timestamp))
+	}
+	if len(c.Data) > 0 {
+		buf = appendBytesField(buf, 3, c.Data)
+	}
+	return buf
+}
+
+// Unmarshal decodes the protobuf encoding of a LogChunk into c, unknown fields
+// are skipped.
+func (c *LogChunk) Unmarshal(buf []byte) error {
+	*c = LogChunk{}
+	for len(buf) > 0 {
+		key, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return errInvalidLogChunk
+		}
+		buf = buf[n:]
+		field, wire := key>>3, key&7
+		switch wire {
+		case wireVarint:
+			v, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return errInvalidLogChunk
+			}
+			buf = buf[n:]
+			if field == 2 {
+				c.Timestamp = int64(v)
+			}
+		case wireBytes:
+			l, n := binary.Uvarint(buf)
+			if n <= 0 || l > uint64(len(buf)-n) {
+				return errInvalidLogChunk
+			}
+			v := buf[n : n+int(l)]
+			buf = buf[n+int(l):]
+			switch field {
+			case 1:
+				c.Stream = string(v)
+			case 3:
+				c.Data = append([]byte(nil), v...)
+			}
+		case wireFixed64, wireFixed32:
+			size := 8
+			if wire == wireFixed32 {
+				size = 4
+			}
+			if len(buf) < size {
+				return errInvalidLogChunk
+			}
+			buf = buf[size:]
+		default:
+			return errInvalidLogChunk
+		}
+	}
+	return nil
+}
+
+// WriteLogChunk writes c to w preceded by its length.
+func WriteLogChunk(w io.Writer, c *LogChunk) error {
+	msg := c.Marshal()
+	_, err := w.Write(append(appendUvarint(make([]byte, 0, len(msg)+binary.MaxVarintLen64), uint64(len(msg))), msg...))
+	return err
+}
+
+// LogChunkReader is the reader that ReadLogChunk needs, a *bufio.Reader is
+// one.
+type LogChunkReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// ReadLogChunk reads a LogChunk that was written by WriteLogChunk. It returns
+// io.EOF if r ends before the next chunk.
+func ReadLogChunk(r LogChunkReader) (*LogChunk, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if l > MaxLogChunkSize {
+		return nil, errInvalidLogChunk
+	}
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	c := &LogChunk{}
+	return c, c.Unmarshal(buf)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func appendBytesField(buf []byte, field uint64, v []byte) []byte {
+	buf = appendUvarint(buf, field<<3|wireBytes)
+	buf = appendUvarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
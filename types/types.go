@@ -3,6 +3,7 @@ package types
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -27,9 +28,16 @@ type Release struct {
 	ArtifactID string                 `json:"artifact,omitempty"`
 	Env        map[string]string      `json:"env,omitempty"`
 	Processes  map[string]ProcessType `json:"processes,omitempty"`
+	Mounts     []Mount                `json:"mounts,omitempty"`
 	CreatedAt  *time.Time             `json:"created_at,omitempty"`
 }
 
+type Mount struct {
+	Path     string `json:"path"`
+	Source   string `json:"source,omitempty"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+}
+
 type ProcessType struct {
 	Cmd   []string          `json:"cmd,omitempty"`
 	Env   map[string]string `json:"env,omitempty"`
@@ -64,20 +72,115 @@ type Key struct {
 	CreatedAt *time.Time `json:"created_at,omitempty"`
 }
 
-type Job struct {
-	ID        string   `json:"id,omitempty"`
-	Type      string   `json:"type,omitempty"`
-	ReleaseID string   `json:"release,omitempty"`
-	Cmd       []string `json:"cmd,omitempty"`
+// NewImageJob is a one-off job that is run straight from an artifact URI
+// instead of from one of the app's releases.
+type NewImageJob struct {
+	ArtifactURI string `json:"artifact_uri"`
+	NewJob
 }
 
-type NewJob struct {
+type Job struct {
+	ID        string            `json:"id,omitempty"`
+	HostID    string            `json:"host_id,omitempty"`
+	JobID     string            `json:"job_id,omitempty"`
+	App       string            `json:"app,omitempty"`
+	Type      string            `json:"type,omitempty"`
 	ReleaseID string            `json:"release,omitempty"`
+	State     string            `json:"state,omitempty"`
 	Cmd       []string          `json:"cmd,omitempty"`
 	Env       map[string]string `json:"env,omitempty"`
-	TTY       bool              `json:"tty,omitempty"`
-	Columns   int               `json:"tty_columns,omitempty"`
-	Lines     int               `json:"tty_lines,omitempty"`
+	Meta      map[string]string `json:"meta,omitempty"`
+	Memory    int64             `json:"memory,omitempty"`
+	CPUShares int64             `json:"cpu_shares,omitempty"`
+	User      string            `json:"user,omitempty"`
+	CreatedAt *time.Time        `json:"created_at,omitempty"`
+	ExitCode  *int              `json:"exit_code,omitempty"`
+	EndedAt   *time.Time        `json:"ended_at,omitempty"`
+	// Host is the host that a one-off job was placed on, it is only set in
+	// the response to running a job.
+	Host *JobHost `json:"host,omitempty"`
+}
+
+type JobHost struct {
+	ID         string            `json:"id"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+const (
+	// JobStateScheduled and JobStatePulling are only reported while a job
+	// that has just been run is getting started.
+	JobStateScheduled = "scheduled"
+	JobStatePulling   = "pulling"
+
+	JobStateStarting = "starting"
+	JobStateUp       = "up"
+	JobStateDown     = "down"
+	JobStateCrashed  = "crashed"
+	JobStateUnknown  = "unknown"
+)
+
+type JobRelease struct {
+	Release  *Release  `json:"release"`
+	Artifact *Artifact `json:"artifact,omitempty"`
+}
+
+type JobEvent struct {
+	JobID    string `json:"job_id"`
+	Type     string `json:"type,omitempty"`
+	State    string `json:"state"`
+	Reason   string `json:"reason,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+}
+
+type KillJobsResult struct {
+	Killed int               `json:"killed"`
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// DrainHostResult is keyed by the IDs of the jobs that were on the drained
+// host. Moved jobs map to the ID of the job that replaced them, skipped and
+// failed jobs to the reason.
+type DrainHostResult struct {
+	Moved   map[string]string `json:"moved"`
+	Skipped map[string]string `json:"skipped"`
+	Failed  map[string]string `json:"failed"`
+}
+
+type NewJob struct {
+	ReleaseID   string            `json:"release,omitempty"`
+	HostID      string            `json:"host_id,omitempty"`
+	Entrypoint  []string          `json:"entrypoint,omitempty"`
+	Cmd         []string          `json:"cmd,omitempty"`
+	Type        string            `json:"type,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	Memory      int64             `json:"memory,omitempty"`
+	CPUShares   int64             `json:"cpu_shares,omitempty"`
+	Timeout     int               `json:"timeout,omitempty"`
+	Constraints map[string]string `json:"constraints,omitempty"`
+	TTY         bool              `json:"tty,omitempty"`
+	Columns     int               `json:"tty_columns,omitempty"`
+	Lines       int               `json:"tty_lines,omitempty"`
+	// ReadOnlyTTY gives the job a TTY for its output without opening its
+	// stdin, input from an attached client is discarded.
+	ReadOnlyTTY bool              `json:"tty_read_only,omitempty"`
+	Stdout      *bool             `json:"stdout,omitempty"`
+	Stderr      *bool             `json:"stderr,omitempty"`
+	Stdin       bool              `json:"stdin,omitempty"`
+	Count       int               `json:"count,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+	// User is the user or uid, optionally followed by :group or :gid, that
+	// the job runs as. The image's user is used if it is empty.
+	User string `json:"user,omitempty"`
+
+	// UseReleaseMounts gives the job all of the release's mounts,
+	// ReleaseMounts only those at the listed paths.
+	UseReleaseMounts bool     `json:"use_release_mounts,omitempty"`
+	ReleaseMounts    []string `json:"release_mounts,omitempty"`
+}
+
+type JobAttach struct {
+	Columns int `json:"tty_columns,omitempty"`
+	Lines   int `json:"tty_lines,omitempty"`
 }
 
 type Frontend struct {
@@ -117,3 +220,42 @@ type ValidationError struct {
 func (v ValidationError) Error() string {
 	return fmt.Sprintf("validation error: %s %s", v.Field, v.Message)
 }
+
+type ValidationErrors []ValidationError
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, e := range v {
+		msgs[i] = e.Field + " " + e.Message
+	}
+	return "validation errors: " + strings.Join(msgs, ", ")
+}
+
+// Error is the body of error responses from the job routes. Code is
+// stable and meant to be checked by clients, Detail depends on the code.
+type Error struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Detail  interface{} `json:"detail,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+const (
+	ErrorCodeValidation      = "validation_error"
+	ErrorCodeValidations     = "validation_errors"
+	ErrorCodeInvalidJSON     = "invalid_json"
+	ErrorCodeRequestTooLarge = "request_too_large"
+	ErrorCodeNotFound        = "not_found"
+	ErrorCodeNotAcceptable   = "not_acceptable"
+	ErrorCodeJobLimit        = "job_limit"
+	ErrorCodeStreamLimit     = "stream_limit"
+	ErrorCodeNoHosts         = "no_hosts"
+	ErrorCodeScheduleFailed  = "schedule_failed"
+	ErrorCodeWouldWait       = "would_wait"
+	ErrorCodeUnreachable     = "host_unreachable"
+	ErrorCodeHostTimeout     = "host_timeout"
+	ErrorCodeInternal        = "internal_error"
+)
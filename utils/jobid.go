@@ -0,0 +1,37 @@
+package utils
+
+import "strings"
+
+var jobIDEscaper = strings.NewReplacer("~", "~~", "-", "~-")
+
+// FormatJobID returns the composite ID that identifies a job and the host it
+// runs on. Dashes and tildes in the host ID are escaped with a tilde, so the
+// first unescaped dash always separates the two parts and host IDs without
+// either character are left as they are.
+func FormatJobID(hostID, jobID string) string {
+	return jobIDEscaper.Replace(hostID) + "-" + jobID
+}
+
+// ParseJobID splits a composite job ID created by FormatJobID into the host
+// and job IDs. Empty strings are returned if the ID is malformed.
+func ParseJobID(id string) (string, string) {
+	hostID := make([]byte, 0, len(id))
+	for i := 0; i < len(id); i++ {
+		switch id[i] {
+		case '~':
+			i++
+			if i == len(id) || (id[i] != '~' && id[i] != '-') {
+				return "", ""
+			}
+			hostID = append(hostID, id[i])
+		case '-':
+			if len(hostID) == 0 || i == len(id)-1 {
+				return "", ""
+			}
+			return string(hostID), id[i+1:]
+		default:
+			hostID = append(hostID, id[i])
+		}
+	}
+	return "", ""
+}
@@ -1,8 +1,10 @@
 package utils
 
 import (
-	"errors"
+	"fmt"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 
 	ct "github.com/flynn/flynn-controller/types"
@@ -10,28 +12,78 @@ import (
 	"github.com/flynn/go-dockerclient"
 )
 
+// FormatEnv merges envs into a list of KEY=value pairs sorted by key. Values
+// in later maps take precedence over earlier ones, and setting a key to the
+// empty string removes it.
 func FormatEnv(envs ...map[string]string) []string {
 	env := make(map[string]string)
 	for _, e := range envs {
 		for k, v := range e {
+			if v == "" {
+				delete(env, k)
+				continue
+			}
 			env[k] = v
 		}
 	}
-	res := make([]string, 0, len(env))
-	for k, v := range env {
-		res = append(res, k+"="+v)
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	res := make([]string, len(keys))
+	for i, k := range keys {
+		res[i] = k + "=" + env[k]
+	}
+	return res
+}
+
+func ParseEnv(env []string) map[string]string {
+	res := make(map[string]string, len(env))
+	for _, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 {
+			res[kv[0]] = kv[1]
+		} else {
+			res[kv[0]] = ""
+		}
 	}
 	return res
 }
 
+// ImageURIError is returned by DockerImage when an artifact URI can't be
+// converted to a Docker image name. Reason describes what is wrong with it.
+type ImageURIError struct {
+	URI    string
+	Reason string
+}
+
+func (e *ImageURIError) Error() string {
+	return fmt.Sprintf("utils: invalid artifact URI %q: %s", e.URI, e.Reason)
+}
+
 func DockerImage(uri string) (string, error) {
 	// TODO: ID refs (see https://github.com/dotcloud/docker/issues/4106)
 	u, err := url.Parse(uri)
+	// the URI may hold registry credentials, keep them out of errors
+	uri = redactURI(uri)
 	if err != nil {
-		return "", err
+		return "", &ImageURIError{uri, "malformed URI"}
 	}
-	if u.Scheme != "docker" {
-		return "", errors.New("utils: only docker artifact URIs are currently supported")
+	switch u.Scheme {
+	case "docker":
+	case "":
+		return "", &ImageURIError{uri, "missing docker:// scheme"}
+	default:
+		return "", &ImageURIError{uri, fmt.Sprintf("unsupported scheme %q, only docker is supported", u.Scheme)}
+	}
+	if i := strings.LastIndex(u.Host, ":"); i >= 0 {
+		if _, err := strconv.ParseUint(u.Host[i+1:], 10, 16); err != nil || i == 0 {
+			return "", &ImageURIError{uri, fmt.Sprintf("invalid registry host %q", u.Host)}
+		}
+	}
+	if strings.Trim(u.Path, "/") == "" && (u.Host == "" || strings.Contains(u.Host, ":")) {
+		return "", &ImageURIError{uri, "missing image name"}
 	}
 	if tag := u.Query().Get("tag"); tag != "" {
 		u.Path += ":" + tag
@@ -43,6 +95,19 @@ func DockerImage(uri string) (string, error) {
 	return u.Host + u.Path, nil
 }
 
+// redactURI replaces the userinfo of uri, if it has any.
+func redactURI(uri string) string {
+	i := strings.Index(uri, "://")
+	if i < 0 {
+		return uri
+	}
+	rest := uri[i+3:]
+	if j := strings.Index(rest, "@"); j >= 0 && !strings.Contains(rest[:j], "/") {
+		return uri[:i+3] + "redacted@" + rest[j+1:]
+	}
+	return uri
+}
+
 func JobConfig(f *ct.ExpandedFormation, name string) (*host.Job, error) {
 	t := f.Release.Processes[name]
 	image, err := DockerImage(f.Artifact.URI)
@@ -70,17 +135,50 @@ func JobConfig(f *ct.ExpandedFormation, name string) (*host.Job, error) {
 	if t.Data {
 		job.Config.Volumes = map[string]struct{}{"/data": {}}
 	}
+	SetProcessHostPorts(job, t)
+	return job, nil
+}
+
+// SetProcessHostPorts binds the ports that a process type lists in its
+// FLYNN_HOST_PORTS to the same ports on the job's host.
+func SetProcessHostPorts(job *host.Job, t ct.ProcessType) {
 	if p := t.Env["FLYNN_HOST_PORTS"]; p != "" {
-		ports := strings.Split(p, ",")
-		job.HostConfig = &docker.HostConfig{
-			PortBindings:    make(map[string][]docker.PortBinding, len(ports)),
-			PublishAllPorts: true,
+		SetHostPorts(job, strings.Split(p, ","))
+	}
+}
+
+// SetHostPorts binds the job's TCP ports to the same ports on its host.
+func SetHostPorts(job *host.Job, ports []string) {
+	if job.HostConfig == nil {
+		job.HostConfig = &docker.HostConfig{}
+	}
+	job.HostConfig.PortBindings = make(map[string][]docker.PortBinding, len(ports))
+	job.HostConfig.PublishAllPorts = true
+	job.Config.ExposedPorts = make(map[string]struct{}, len(ports))
+	for _, port := range ports {
+		job.Config.ExposedPorts[port+"/tcp"] = struct{}{}
+		job.HostConfig.PortBindings[port+"/tcp"] = []docker.PortBinding{{HostPort: port}}
+	}
+}
+
+// SetMounts adds release mounts to a job, mounts with a source are bound from
+// the host and the rest are volumes.
+func SetMounts(job *host.Job, mounts []ct.Mount) {
+	for _, m := range mounts {
+		if job.Config.Volumes == nil {
+			job.Config.Volumes = make(map[string]struct{}, len(mounts))
 		}
-		job.Config.ExposedPorts = make(map[string]struct{}, len(ports))
-		for _, port := range ports {
-			job.Config.ExposedPorts[port+"/tcp"] = struct{}{}
-			job.HostConfig.PortBindings[port+"/tcp"] = []docker.PortBinding{{HostPort: port}}
+		job.Config.Volumes[m.Path] = struct{}{}
+		if m.Source == "" {
+			continue
 		}
+		if job.HostConfig == nil {
+			job.HostConfig = &docker.HostConfig{}
+		}
+		bind := m.Source + ":" + m.Path
+		if m.ReadOnly {
+			bind += ":ro"
+		}
+		job.HostConfig.Binds = append(job.HostConfig.Binds, bind)
 	}
-	return job, nil
 }
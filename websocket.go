@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	ct "github.com/flynn/flynn-controller/types"
+)
+
+// This is a minimal server implementation of the WebSocket protocol (RFC
+// 6455), just enough to bridge attach streams to browsers. Messages are not
+// reassembled, the payloads of data frames are presented as a single byte
+// stream.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+func isWebSocketUpgrade(req *http.Request) bool {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range strings.Split(req.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+func validateWebSocketRequest(req *http.Request) error {
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		return ct.ValidationError{Field: "Sec-WebSocket-Version", Message: "must be 13"}
+	}
+	if req.Header.Get("Sec-WebSocket-Key") == "" {
+		return ct.ValidationError{Field: "Sec-WebSocket-Key", Message: "must not be blank"}
+	}
+	return nil
+}
+
+func websocketAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+websocketGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// upgradeWebSocket hijacks the connection and completes the opening
+// handshake. The request must have been checked with validateWebSocketRequest.
+func upgradeWebSocket(w http.ResponseWriter, req *http.Request) (*websocketConn, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("websocket: connection does not support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", websocketAccept(req.Header.Get("Sec-WebSocket-Key")))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &websocketConn{conn: conn, r: rw.Reader}, nil
+}
+
+// websocketConn implements cluster.ReadWriteCloser over a WebSocket
+// connection. Writes are sent as binary messages and CloseWrite sends a close
+// frame.
+type websocketConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	// remaining is the number of unread payload bytes in the current data
+	// frame
+	remaining int64
+	mask      [4]byte
+	maskPos   int
+	closed    bool
+
+	wmtx        sync.Mutex
+	writeClosed bool
+}
+
+func (c *websocketConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= int64(n)
+	return n, err
+}
+
+func (c *websocketConn) unmask(p []byte) {
+	for i := range p {
+		p[i] ^= c.mask[c.maskPos%4]
+		c.maskPos++
+	}
+}
+
+// nextFrame reads frame headers, handling any control frames, until it reaches
+// a data frame or a close frame.
+func (c *websocketConn) nextFrame() error {
+	var h [2]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		return err
+	}
+	op := h[0] & 0xf
+	length := int64(h[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(b[:]))
+		if length < 0 {
+			return errors.New("websocket: invalid frame length")
+		}
+	}
+	if h[1]&0x80 == 0 {
+		return errors.New("websocket: client frame is not masked")
+	}
+	if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+		return err
+	}
+	c.maskPos = 0
+
+	switch op {
+	case wsOpContinuation, wsOpText, wsOpBinary:
+		c.remaining = length
+		return nil
+	case wsOpClose:
+		c.closed = true
+		_, err := io.CopyN(ioutil.Discard, c.r, length)
+		return err
+	case wsOpPing:
+		if length > 125 {
+			return errors.New("websocket: control frame too long")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		return c.writeFrame(wsOpPong, payload)
+	case wsOpPong:
+		_, err := io.CopyN(ioutil.Discard, c.r, length)
+		return err
+	default:
+		return fmt.Errorf("websocket: unknown opcode %d", op)
+	}
+}
+
+func (c *websocketConn) writeFrame(op byte, p []byte) error {
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | op
+	switch {
+	case len(p) < 126:
+		header[1] = byte(len(p))
+	case len(p) <= 0xffff:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(len(p)))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(len(p)))
+	}
+
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+	if c.writeClosed {
+		// nothing may be sent after a close frame
+		return errors.New("websocket: write after close")
+	}
+	if op == wsOpClose {
+		c.writeClosed = true
+	}
+	if _, err := c.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(p)
+	return err
+}
+
+func (c *websocketConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// CloseWrite sends a close frame with the normal closure status code.
+func (c *websocketConn) CloseWrite() error {
+	return c.writeFrame(wsOpClose, []byte{0x03, 0xe8})
+}
+
+func (c *websocketConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	ct "github.com/flynn/flynn-controller/types"
+	"github.com/flynn/flynn-controller/utils"
+	"github.com/flynn/flynn-host/types"
+	"github.com/flynn/go-flynn/cluster"
+	. "github.com/titanous/gocheck"
+)
+
+func writeClientFrame(w io.Writer, op byte, payload []byte) error {
+	header := []byte{0x80 | op, 0x80 | byte(len(payload))}
+	mask := []byte{1, 2, 3, 4}
+	masked := make([]byte, len(payload))
+	for i, b := range payload {
+		masked[i] = b ^ mask[i%4]
+	}
+	_, err := w.Write(append(append(header, mask...), masked...))
+	return err
+}
+
+func readServerFrame(r io.Reader) (byte, []byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, nil, err
+	}
+	length := int(h[1] & 0x7f)
+	if length == 126 {
+		var b [2]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		length = int(binary.BigEndian.Uint16(b[:]))
+	}
+	payload := make([]byte, length)
+	_, err := io.ReadFull(r, payload)
+	return h[0] & 0xf, payload, err
+}
+
+func (s *S) TestWebSocketAccept(c *C) {
+	// example from RFC 6455 section 1.3
+	c.Assert(websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="), Equals, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+}
+
+func (s *S) TestRunJobWebSocket(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "run-websocket"})
+	hc := newFakeHostClient()
+
+	hostID := utils.UUID()
+	done := make(chan struct{})
+	hc.setAttachFunc("*", func(req *host.AttachReq, wait bool) (cluster.ReadWriteCloser, func() error, error) {
+		c.Assert(req.Flags, Equals, host.AttachFlagStdout|host.AttachFlagStderr|host.AttachFlagStdin|host.AttachFlagStream)
+		piper, pipew := io.Pipe()
+		stdoutr, stdoutw := io.Pipe()
+		go func() {
+			stdin, err := ioutil.ReadAll(piper)
+			c.Assert(err, IsNil)
+			c.Assert(string(stdin), Equals, "test in")
+			close(done)
+			stdoutw.Write([]byte("test out"))
+			stdoutw.Close()
+		}()
+		return &fakeAttachStream{stdoutr, pipew}, func() error { return nil }, nil
+	})
+	s.cc.setHostClient(hostID, hc)
+	s.cc.setHosts(map[string]host.Host{hostID: {}})
+
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://foo/bar"})
+	release := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+
+	data, _ := json.Marshal(&ct.NewJob{ReleaseID: release.ID, Cmd: []string{"sh"}})
+	req, err := http.NewRequest("POST", s.srv.URL+"/apps/"+app.ID+"/jobs", bytes.NewBuffer(data))
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	conn, err := net.Dial("tcp", req.URL.Host)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	c.Assert(req.Write(conn), IsNil)
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 101)
+	c.Assert(res.Header.Get("Sec-WebSocket-Accept"), Equals, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+
+	c.Assert(writeClientFrame(conn, wsOpPing, []byte("ping")), IsNil)
+	c.Assert(writeClientFrame(conn, wsOpBinary, []byte("test ")), IsNil)
+	c.Assert(writeClientFrame(conn, wsOpText, []byte("in")), IsNil)
+	c.Assert(writeClientFrame(conn, wsOpClose, nil), IsNil)
+	<-done
+
+	var stdout []byte
+	var pong bool
+	for {
+		op, payload, err := readServerFrame(br)
+		c.Assert(err, IsNil)
+		if op == wsOpClose {
+			break
+		}
+		switch op {
+		case wsOpPong:
+			c.Assert(string(payload), Equals, "ping")
+			pong = true
+		case wsOpBinary:
+			stdout = append(stdout, payload...)
+		}
+	}
+	c.Assert(pong, Equals, true)
+	c.Assert(string(stdout), Equals, "test out")
+	c.Assert(s.cc.hosts[hostID].Jobs[0].Config.OpenStdin, Equals, true)
+
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(data))
+	res, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+}